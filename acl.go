@@ -0,0 +1,183 @@
+package dcache
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+/*
+多个团队共享一个集群时, 按身份限制每个group允许的操作.
+身份来自请求认证(Authenticator)或mTLS客户端证书(SPIFFE ID或CN), 没有身份的请求记为anonymous.
+ACL文件修改后在之后的请求中自动重新加载.
+PUT和DELETE会被转发到key的owner节点, 所以peer的身份需要set和delete权限.
+
+ACL文件示例:
+
+	{
+	  "rules": [
+	    {"identity": "team-a", "groups": ["scores", "team-a-*"], "ops": ["get", "set"]},
+	    {"identity": "ops", "groups": ["*"], "ops": ["get", "set", "delete", "admin"]},
+	    {"identity": "dcache-peer", "groups": ["*"], "ops": ["get", "set", "delete", "lease"]}
+	  ]
+	}
+*/
+
+// An Op is an operation on a group checked by an ACL.
+type Op string
+
+const (
+	OpGet    Op = "get"
+	OpSet    Op = "set"
+	OpDelete Op = "delete"
+	OpAdmin  Op = "admin"
+	// OpLease is needed for the lease RPCs peers use to coordinate loads
+	// while a key's owner is down. The value a lease holder releases is
+	// cached by every waiting node, so grant it to peer identities only.
+	OpLease Op = "lease"
+)
+
+// Anonymous is the identity of requests that are not authenticated.
+const Anonymous = "anonymous"
+
+const defaultACLReloadInterval = 10 * time.Second
+
+// An ACLRule allows Identity the Ops on groups matching one of Groups.
+// Identity "*" matches every authenticated identity, Groups are path.Match
+// patterns.
+type ACLRule struct {
+	Identity string   `json:"identity"`
+	Groups   []string `json:"groups"`
+	Ops      []Op     `json:"ops"`
+}
+
+// An ACL maps identities to the operations they may perform per group,
+// anything not allowed by a rule is denied.
+type ACL struct {
+	file     string
+	interval time.Duration
+
+	mu        sync.RWMutex
+	rules     []ACLRule
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// LoadACL reads the ACL in file, which is reloaded when it changes.
+// If reloadInterval is 0, the file is checked every 10s.
+func LoadACL(file string, reloadInterval time.Duration) (*ACL, error) {
+	if reloadInterval == 0 {
+		reloadInterval = defaultACLReloadInterval
+	}
+	a := &ACL{file: file, interval: reloadInterval}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *ACL) load() error {
+	fi, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(a.file)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		Rules []ACLRule `json:"rules"`
+	}
+	if err = json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("dcache: parsing ACL %v: %w", a.file, err)
+	}
+	for _, r := range f.Rules {
+		for _, g := range r.Groups {
+			if _, err := path.Match(g, ""); err != nil {
+				return fmt.Errorf("dcache: bad group pattern %q in ACL %v", g, a.file)
+			}
+		}
+	}
+
+	a.mu.Lock()
+	a.rules, a.modTime = f.Rules, fi.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+// reload reloads the file if it changed, a broken file keeps the old rules
+func (a *ACL) reload() {
+	a.mu.Lock()
+	if time.Since(a.lastCheck) < a.interval {
+		a.mu.Unlock()
+		return
+	}
+	a.lastCheck = time.Now()
+	loaded := a.modTime
+	a.mu.Unlock()
+
+	if fi, err := os.Stat(a.file); err == nil && !fi.ModTime().Equal(loaded) {
+		if err := a.load(); err != nil {
+			log.Println("[DCache] Failed to reload ACL", err)
+		}
+	}
+}
+
+// Allow reports whether identity may perform op on group.
+func (a *ACL) Allow(identity, group string, op Op) bool {
+	a.reload()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.rules {
+		if r.Identity != identity && (r.Identity != "*" || identity == Anonymous) {
+			continue
+		}
+		if !slices.Contains(r.Ops, op) {
+			continue
+		}
+		for _, g := range r.Groups {
+			if ok, _ := path.Match(g, group); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestIdentity returns who sent the request being served: the identity
+// verified by an Authenticator, else the client certificate's SPIFFE ID or
+// common name, else Anonymous
+func requestIdentity(ctx context.Context, cs *tls.ConnectionState) string {
+	if id, ok := IdentityFromContext(ctx); ok {
+		return id
+	}
+	if cs == nil {
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				cs = &info.State
+			}
+		}
+	}
+	if cs != nil && len(cs.PeerCertificates) > 0 {
+		cert := cs.PeerCertificates[0]
+		for _, u := range cert.URIs {
+			if u.Scheme == "spiffe" {
+				return u.String()
+			}
+		}
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName
+		}
+	}
+	return Anonymous
+}
@@ -0,0 +1,196 @@
+package dcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"dcache/consistenthash"
+)
+
+// adminPath derives the default AdminPath from a BasePath
+func adminPath(base string) string {
+	return "/" + strings.TrimPrefix(strings.TrimRight(base, "/_"), "/") + "_admin/"
+}
+
+// AdminHandler returns a handler for inspecting and managing this node,
+// to be mounted at HTTPPoolOptions.AdminPath beside p, by default
+// http.Handle("/_dcache_admin/", p.AdminHandler())
+//
+//	GET  /_dcache_admin/groups                     groups with sizes and stats
+//	GET  /_dcache_admin/key?group=<name>&key=<key>  owner, cached here, ttl, size
+//	GET  /_dcache_admin/ring                       virtual nodes per peer
+//	POST /_dcache_admin/evict?group=<name>&key=<key>
+//	POST /_dcache_admin/flush?group=<name>
+//
+// Requests are authenticated by the pool's Auth, and need OpAdmin in its ACL
+// for the group concerned, or for "*" for the ring.
+func (p *HTTPPool) AdminHandler() http.Handler {
+	return http.HandlerFunc(p.serveAdmin)
+}
+
+func (p *HTTPPool) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, p.opts.AdminPath) {
+		http.NotFound(w, r)
+		return
+	}
+	p.Log("admin %s %s", r.Method, r.URL.Path)
+	if r = p.authenticate(w, r); r == nil {
+		return
+	}
+
+	method := http.MethodGet
+	switch r.URL.Path[len(p.opts.AdminPath):] {
+	case "groups":
+		p.adminGroups(w, r)
+		return
+	case "ring":
+		if p.adminAllowed(w, r, "*") {
+			p.adminRing(w)
+		}
+		return
+	case "key":
+	case "evict", "flush":
+		method = http.MethodPost
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupName := r.URL.Query().Get("group")
+	if !p.adminAllowed(w, r, groupName) {
+		return
+	}
+	group := p.opts.Registry.GetGroup(groupName)
+	if group == nil {
+		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	switch r.URL.Path[len(p.opts.AdminPath):] {
+	case "key":
+		p.adminKey(w, group, key)
+	case "evict":
+		group.Remove(key)
+		w.WriteHeader(http.StatusNoContent)
+	case "flush":
+		group.flush()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// adminAllowed reports whether the caller may administer group,
+// answering 403 if not
+func (p *HTTPPool) adminAllowed(w http.ResponseWriter, r *http.Request, group string) bool {
+	if p.opts.ACL == nil {
+		return true
+	}
+	identity := requestIdentity(r.Context(), r.TLS)
+	if !p.opts.ACL.Allow(identity, group, OpAdmin) {
+		http.Error(w, fmt.Sprintf("%v may not %v %v", identity, OpAdmin, group), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type adminGroup struct {
+	Name       string     `json:"name"`
+	CacheBytes int64      `json:"cacheBytes"` // 0 means unlimited
+	Cache      CacheStats `json:"cache"`
+	HotCache   CacheStats `json:"hotCache"`
+	Stats      *Stats     `json:"stats"`
+}
+
+// adminGroups lists the groups the caller may administer
+func (p *HTTPPool) adminGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	identity := requestIdentity(r.Context(), r.TLS)
+	list := []adminGroup{}
+	for _, g := range p.opts.Registry.Groups() {
+		if p.opts.ACL != nil && !p.opts.ACL.Allow(identity, g.name, OpAdmin) {
+			continue
+		}
+		list = append(list, adminGroup{
+			Name:       g.name,
+			CacheBytes: g.config.CacheBytes,
+			Cache:      g.CacheStats(),
+			HotCache:   g.HotCacheStats(),
+			Stats:      &g.Stats,
+		})
+	}
+	writeJSON(w, list)
+}
+
+type adminKey struct {
+	Group       string `json:"group"`
+	Key         string `json:"key"`
+	Owner       string `json:"owner"` // "" if there are no peers
+	Self        string `json:"self"`
+	Cached      bool   `json:"cached"`         // cached on this node
+	Size        int    `json:"size,omitempty"` // bytes stored, compressed if Compression is set
+	Compression string `json:"compression,omitempty"`
+	TTL         int    `json:"ttl,omitempty"` // seconds left, omitted if it never expires
+	Expires     string `json:"expires,omitempty"`
+	Version     string `json:"version,omitempty"`
+}
+
+// adminKey describes key without loading it
+func (p *HTTPPool) adminKey(w http.ResponseWriter, group *Group, key string) {
+	info := adminKey{
+		Group: group.name,
+		Key:   key,
+		Owner: p.owner(key),
+		Self:  p.self,
+	}
+	if it, expire, ok := group.peek(key); ok {
+		info.Cached = true
+		info.Size = len(it.b)
+		if it.compression != CompressNone {
+			info.Compression = it.compression.String()
+		}
+		info.TTL = ttlSeconds(expire)
+		if !expire.IsZero() {
+			info.Expires = expire.UTC().Format(time.RFC3339)
+		}
+		info.Version = strings.Trim(etag(it), `"`)
+	}
+	writeJSON(w, info)
+}
+
+type adminRing struct {
+	Self     string                                 `json:"self"`
+	Replicas int                                    `json:"replicas"`
+	Peers    map[string]consistenthash.Distribution `json:"peers"`
+}
+
+func (p *HTTPPool) adminRing(w http.ResponseWriter) {
+	p.mu.Lock()
+	ring := adminRing{
+		Self:     p.self,
+		Replicas: p.opts.Replicas,
+		Peers:    p.peers.Distribution(),
+	}
+	p.mu.Unlock()
+	writeJSON(w, ring)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(body)
+}
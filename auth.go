@@ -0,0 +1,365 @@
+package dcache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"dcache/pb"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+节点间请求认证. 客户端(httpGetter/grpcGetter)自动为每个请求签名,
+服务端(HTTPPool.ServeHTTP/GrpcPool)校验后才处理请求, 校验通过的身份保存在context中供ACL使用.
+签名放在HTTP的Authorization header或gRPC的authorization metadata中.
+签名覆盖请求体(HTTP body或gRPC请求消息的确定性编码), 传输中被修改的请求无法通过校验.
+*/
+
+// ErrUnauthenticated is returned when a request carries no valid credentials.
+var ErrUnauthenticated = errors.New("dcache: unauthenticated")
+
+// An Authenticator signs requests to peers and verifies requests from peers.
+// method is the HTTP method or the gRPC full method name, resource names what
+// is accessed, e.g. "/_dcache_/scores/Tom" or "scores/Tom", and body is the
+// HTTP request body or the deterministic encoding of the gRPC request.
+type Authenticator interface {
+	// Sign returns the Authorization value for a request.
+	Sign(method, resource string, body []byte) (string, error)
+	// Verify checks an Authorization value and returns the caller's identity.
+	Verify(method, resource string, body []byte, authorization string) (identity string, err error)
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the authenticated identity of the peer that
+// sent the request being served.
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(identityKey{}).(string)
+	return id, ok
+}
+
+func withIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+const hmacScheme = "DCache-HMAC-SHA256"
+
+// HMACAuth signs requests with a shared secret, a timestamp and a nonce.
+// Requests outside the replay window, or reusing a nonce, are rejected.
+// The identity of a verified request is the id of the key it was signed with.
+type HMACAuth struct {
+	signKey string
+	keys    map[string][]byte
+	window  time.Duration
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time // nonces seen within the window
+	lastSweep time.Time            // when expired nonces were last removed
+}
+
+// NewHMACAuth signs with keys[signKey] and accepts any key in keys, so a
+// new secret can be rolled out to every node before it is used for signing.
+func NewHMACAuth(signKey string, keys map[string][]byte, window time.Duration) *HMACAuth {
+	if _, ok := keys[signKey]; !ok {
+		panic("dcache: signKey not in keys")
+	}
+	return &HMACAuth{signKey: signKey, keys: keys, window: window, nonces: make(map[string]time.Time)}
+}
+
+func (a *HMACAuth) Sign(method, resource string, body []byte) (string, error) {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(b[:])
+	sig := a.mac(a.keys[a.signKey], method, resource, body, ts, nonce)
+	return fmt.Sprintf("%s key=%s,ts=%s,nonce=%s,sig=%s", hmacScheme, a.signKey, ts, nonce, sig), nil
+}
+
+func (a *HMACAuth) Verify(method, resource string, body []byte, authorization string) (string, error) {
+	params, ok := strings.CutPrefix(authorization, hmacScheme+" ")
+	if !ok {
+		return "", ErrUnauthenticated
+	}
+	fields := make(map[string]string, 4)
+	for _, kv := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		fields[k] = v
+	}
+	secret, ok := a.keys[fields["key"]]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown key %q", ErrUnauthenticated, fields["key"])
+	}
+	want := a.mac(secret, method, resource, body, fields["ts"], fields["nonce"])
+	if !hmac.Equal([]byte(want), []byte(fields["sig"])) {
+		return "", fmt.Errorf("%w: bad signature", ErrUnauthenticated)
+	}
+
+	unix, err := strconv.ParseInt(fields["ts"], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: bad timestamp", ErrUnauthenticated)
+	}
+	now := time.Now()
+	if ts := time.Unix(unix, 0); ts.Before(now.Add(-a.window)) || ts.After(now.Add(a.window)) {
+		return "", fmt.Errorf("%w: timestamp outside replay window", ErrUnauthenticated)
+	}
+	if !a.useNonce(fields["nonce"], now) {
+		return "", fmt.Errorf("%w: replayed request", ErrUnauthenticated)
+	}
+	return fields["key"], nil
+}
+
+func (a *HMACAuth) mac(secret []byte, method, resource string, body []byte, ts, nonce string) string {
+	digest := sha256.Sum256(body)
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(method + "\n" + resource + "\n" + hex.EncodeToString(digest[:]) + "\n" + ts + "\n" + nonce))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// useNonce records nonce, it returns false if it was seen within the window
+func (a *HMACAuth) useNonce(nonce string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.nonces[nonce]; ok {
+		return false
+	}
+	// 时间戳超出窗口的请求已被拒绝, 所以只需记住两倍窗口内的nonce.
+	// 每个窗口最多清理一次, map中最多保留约三个窗口的nonce
+	if now.Sub(a.lastSweep) >= a.window {
+		for n, exp := range a.nonces {
+			if now.After(exp) {
+				delete(a.nonces, n)
+			}
+		}
+		a.lastSweep = now
+	}
+	a.nonces[nonce] = now.Add(2 * a.window)
+	return true
+}
+
+// BearerAuth authenticates requests with static bearer tokens.
+type BearerAuth struct {
+	token  string
+	tokens map[string]string // token -> identity
+}
+
+// NewBearerAuth sends token and accepts every token in tokens, which maps
+// tokens to the identity of their holder.
+func NewBearerAuth(token string, tokens map[string]string) *BearerAuth {
+	return &BearerAuth{token: token, tokens: tokens}
+}
+
+func (a *BearerAuth) Sign(method, resource string, body []byte) (string, error) {
+	return "Bearer " + a.token, nil
+}
+
+func (a *BearerAuth) Verify(method, resource string, body []byte, authorization string) (string, error) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return "", ErrUnauthenticated
+	}
+	// 逐个常量时间比较, 避免通过耗时猜出token
+	identity, found := "", 0
+	for t, id := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			identity, found = id, 1
+		}
+	}
+	if found == 0 {
+		return "", ErrUnauthenticated
+	}
+	return identity, nil
+}
+
+// grpcResource names what a gRPC request accesses
+func grpcResource(req interface{}) string {
+	switch r := req.(type) {
+	case *pb.Request:
+		return r.GetGroup() + "/" + r.GetKey()
+	case *pb.LeaseRequest:
+		return r.GetGroup() + "/" + r.GetKey()
+	}
+	return ""
+}
+
+// grpcBody is the body signed for a gRPC request. Marshaling is
+// deterministic, so the server gets the same bytes from the decoded message.
+func grpcBody(req interface{}) ([]byte, error) {
+	m, ok := req.(proto.Message)
+	if !ok {
+		return nil, nil
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(m)
+}
+
+// unaryClientAuth signs every outgoing RPC
+func unaryClientAuth(auth Authenticator) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		body, err := grpcBody(req)
+		if err != nil {
+			return err
+		}
+		authorization, err := auth.Sign(method, grpcResource(req), body)
+		if err != nil {
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", authorization)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// unaryServerAuth verifies every incoming RPC
+func unaryServerAuth(auth Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var authorization string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if v := md.Get("authorization"); len(v) > 0 {
+				authorization = v[0]
+			}
+		}
+		body, err := grpcBody(req)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		identity, err := auth.Verify(info.FullMethod, grpcResource(req), body, authorization)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		return handler(withIdentity(ctx, identity), req)
+	}
+}
+
+// streamClientAuth signs outgoing streams. The request is only known when
+// it is sent, so the stream is opened lazily on the first SendMsg.
+func streamClientAuth(auth Authenticator) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return &authClientStream{ctx: ctx, desc: desc, cc: cc, method: method, streamer: streamer, opts: opts, auth: auth}, nil
+	}
+}
+
+type authClientStream struct {
+	grpc.ClientStream // nil until the first SendMsg
+
+	ctx      context.Context
+	desc     *grpc.StreamDesc
+	cc       *grpc.ClientConn
+	method   string
+	streamer grpc.Streamer
+	opts     []grpc.CallOption
+	auth     Authenticator
+}
+
+var errStreamNotStarted = status.Error(codes.Internal, "dcache: stream used before its request was sent")
+
+func (s *authClientStream) SendMsg(m interface{}) error {
+	if s.ClientStream == nil {
+		body, err := grpcBody(m)
+		if err != nil {
+			return err
+		}
+		authorization, err := s.auth.Sign(s.method, grpcResource(m), body)
+		if err != nil {
+			return err
+		}
+		ctx := metadata.AppendToOutgoingContext(s.ctx, "authorization", authorization)
+		if s.ClientStream, err = s.streamer(ctx, s.desc, s.cc, s.method, s.opts...); err != nil {
+			return err
+		}
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *authClientStream) RecvMsg(m interface{}) error {
+	if s.ClientStream == nil {
+		return errStreamNotStarted
+	}
+	return s.ClientStream.RecvMsg(m)
+}
+
+func (s *authClientStream) CloseSend() error {
+	if s.ClientStream == nil {
+		return errStreamNotStarted
+	}
+	return s.ClientStream.CloseSend()
+}
+
+func (s *authClientStream) Header() (metadata.MD, error) {
+	if s.ClientStream == nil {
+		return nil, errStreamNotStarted
+	}
+	return s.ClientStream.Header()
+}
+
+func (s *authClientStream) Trailer() metadata.MD {
+	if s.ClientStream == nil {
+		return nil
+	}
+	return s.ClientStream.Trailer()
+}
+
+func (s *authClientStream) Context() context.Context {
+	if s.ClientStream == nil {
+		return s.ctx
+	}
+	return s.ClientStream.Context()
+}
+
+// streamServerAuth verifies incoming streams against their first request
+func streamServerAuth(auth Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &authServerStream{ServerStream: ss, ctx: ss.Context(), method: info.FullMethod, auth: auth})
+	}
+}
+
+type authServerStream struct {
+	grpc.ServerStream
+	ctx      context.Context // carries the identity once verified
+	method   string
+	auth     Authenticator
+	verified bool
+}
+
+func (s *authServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.verified {
+		return nil
+	}
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(s.ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			authorization = v[0]
+		}
+	}
+	body, err := grpcBody(m)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	identity, err := s.auth.Verify(s.method, grpcResource(m), body, authorization)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	s.ctx, s.verified = withIdentity(s.ctx, identity), true
+	return nil
+}
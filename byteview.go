@@ -1,23 +1,99 @@
 package dcache
 
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
 // A ByteView holds an immutable view of bytes.
+// The methods below read the bytes in place, only ByteSlice and String copy.
+// A view of a compressed value is decompressed when it is first read.
 type ByteView struct {
 	b []byte
+	z *inflated // non-nil if b is compressed, see compress.go
 }
 
 // Len returns the view's length
 func (v ByteView) Len() int {
-	return len(v.b)
+	return len(v.data())
 }
 
 // ByteSlice returns a copy of the data as a byte slice.
 func (v ByteView) ByteSlice() []byte {
-	return cloneBytes(v.b)
+	return cloneBytes(v.data())
 }
 
 // String returns the data as a string, making a copy if necessary.
 func (v ByteView) String() string {
-	return string(v.b)
+	return string(v.data())
+}
+
+// At returns the byte at index i.
+func (v ByteView) At(i int) byte {
+	return v.data()[i]
+}
+
+// Slice slices the view between the provided from and to indices.
+func (v ByteView) Slice(from, to int) ByteView {
+	return ByteView{b: v.data()[from:to]}
+}
+
+// SliceFrom slices the view from the provided index until the end.
+func (v ByteView) SliceFrom(from int) ByteView {
+	return ByteView{b: v.data()[from:]}
+}
+
+// Copy copies b into dest and returns the number of bytes copied.
+func (v ByteView) Copy(dest []byte) int {
+	return copy(dest, v.data())
+}
+
+// Equal returns whether the bytes in b are the same as the bytes in b2.
+func (v ByteView) Equal(b2 ByteView) bool {
+	return bytes.Equal(v.data(), b2.data())
+}
+
+// EqualBytes returns whether the bytes in b are the same as the bytes b2.
+func (v ByteView) EqualBytes(b2 []byte) bool {
+	return bytes.Equal(v.data(), b2)
+}
+
+// EqualString returns whether the bytes in b are the same as the bytes in s.
+func (v ByteView) EqualString(s string) bool {
+	return string(v.data()) == s
+}
+
+// Reader returns an io.ReadSeeker for the bytes in v.
+func (v ByteView) Reader() io.ReadSeeker {
+	return bytes.NewReader(v.data())
+}
+
+// ReadAt implements io.ReaderAt on the bytes in v.
+func (v ByteView) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("view: invalid offset")
+	}
+	b := v.data()
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n = copy(p, b[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// WriteTo implements io.WriterTo on the bytes in v, e.g. to send a value
+// to an http.ResponseWriter without copying it first.
+func (v ByteView) WriteTo(w io.Writer) (n int64, err error) {
+	b := v.data()
+	m, err := w.Write(b)
+	if err == nil && m != len(b) {
+		err = io.ErrShortWrite
+	}
+	return int64(m), err
 }
 
 func cloneBytes(b []byte) []byte {
@@ -2,35 +2,382 @@ package dcache
 
 import (
 	"dcache/lru"
+	"dcache/ringcache"
+	"encoding/binary"
+	"hash/fnv"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// item is what the cache stores for a key: the value plus the metadata
+// HTTPPool needs for ETag and Last-Modified. The bytes are stored as they
+// are, compressed or not, and wrapped in a new ByteView for every reader so
+// that decompressed copies are not kept in the cache.
+//
+// The lru stores every value as one item. ringcache entries must fit in a
+// shard, so larger values are stored there as a manifest item with no bytes
+// and chunks > 0, plus one item per chunk whose version is the chunk's
+// CRC-32C. A value is only read back if all its chunks are present and
+// match their checksum, so evicting a single chunk can not serve corrupt data.
+type item struct {
+	ByteView
+	modified time.Time // when the value was stored
+	version  uint64    // FNV-1a hash of the value
+	chunks   int       // number of chunks of a manifest, 0 if not chunked
+
+	compression Compression // how the stored bytes are compressed
+}
+
+// defaultEntryOverhead is the memory each cached key costs besides its key
+// and value bytes, the item is stored inline in the lru entry
+var defaultEntryOverhead = lru.EntryOverhead[string, item]()
+
+// itemSize is the lru.Sizer of cache
+func itemSize(key string, it item) int64 {
+	return int64(len(key) + len(it.b))
+}
+
+func newItem(value ByteView, modified time.Time) item {
+	return item{
+		ByteView:    ByteView{b: value.b},
+		modified:    modified,
+		version:     hashBytes(value.b),
+		compression: value.compression(),
+	}
+}
+
+// view returns the value of it for a reader
+func (it item) view() ByteView {
+	return compressedView(it.b, it.compression)
+}
+
+func hashBytes(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// defaultChunkSize is the largest chunk large values are stored in
+const defaultChunkSize = 1 << 20
+
+// Keys in ringcache are prefixed so that values and chunks live in separate
+// namespaces, whatever bytes a key contains
+const (
+	ringValuePrefix = 'v'
+	ringChunkPrefix = 'c'
+)
+
+func ringKey(key string) string {
+	return string(ringValuePrefix) + key
+}
+
+// chunkKey is the ringcache key chunk i of key's value is stored under
+func chunkKey(key string, i int) string {
+	return string(ringChunkPrefix) + strconv.Itoa(i) + "\x00" + key
+}
+
+// encodeItem serializes it for ringcache: modified, version, chunks and
+// compression, then the value
+func encodeItem(it item) []byte {
+	b := make([]byte, 21+len(it.b))
+	binary.LittleEndian.PutUint64(b, uint64(it.modified.UnixNano()))
+	binary.LittleEndian.PutUint64(b[8:], it.version)
+	binary.LittleEndian.PutUint32(b[16:], uint32(it.chunks))
+	b[20] = byte(it.compression)
+	copy(b[21:], it.b)
+	return b
+}
+
+func decodeItem(b []byte) item {
+	return item{
+		ByteView:    ByteView{b: b[21:]},
+		modified:    time.Unix(0, int64(binary.LittleEndian.Uint64(b))),
+		version:     binary.LittleEndian.Uint64(b[8:]),
+		chunks:      int(binary.LittleEndian.Uint32(b[16:])),
+		compression: Compression(b[20]),
+	}
+}
+
 type cache struct {
 	mu         sync.Mutex
-	lru        *lru.Cache
+	lru        *lru.Cache[string, item]
+	ring       *ringcache.Cache // used instead of lru with StorageRing
+	storage    Storage
 	cacheBytes int64
+	maxEntries int            // 0 means no limit
+	policy     EvictionPolicy // LRU or FIFO
+	beta       float64        // XFetch beta, 0 disables early expiration
+	onEvicted  func(key string)
+	overhead   int64 // charged per entry, see lru.Cache.EntryOverhead
+	chunkSize  int   // ring values larger than this are chunked, set on first add
+
+	nhit, nget int64
+	nevict     int64 // number of evictions
+	closed     bool  // set by close, adds are dropped
+}
+
+// CacheStats are returned by stats accessors on Group.
+type CacheStats struct {
+	Bytes     int64 // estimated memory used, including Overhead
+	Overhead  int64 // estimated memory used besides keys and values
+	Items     int64
+	Gets      int64
+	Hits      int64
+	Evictions int64
 }
 
-func (c *cache) add(key string, value ByteView, expire time.Time) {
+func (c *cache) stats() CacheStats {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = lru.New(c.cacheBytes, nil) // Lazy Initialization
+	var st lru.Stats
+	if c.lru != nil {
+		st = c.lru.Stats()
+	}
+	if c.ring != nil {
+		rst := c.ring.Stats()
+		st = lru.Stats{Entries: rst.Entries, Data: rst.Data, Overhead: rst.Overhead, Bytes: rst.Bytes}
+	}
+	return CacheStats{
+		Bytes:     st.Bytes,
+		Overhead:  st.Overhead,
+		Items:     int64(st.Entries),
+		Gets:      c.nget,
+		Hits:      c.nhit,
+		Evictions: c.nevict,
 	}
-	c.lru.Add(key, value, expire)
 }
 
-func (c *cache) get(key string) (value ByteView, ok bool) {
+func (c *cache) bytes() int64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.bytesLocked()
+}
+
+func (c *cache) bytesLocked() int64 {
+	if c.ring != nil {
+		return c.ring.Stats().Bytes
+	}
 	if c.lru == nil {
+		return 0
+	}
+	return c.lru.Bytes()
+}
+
+func (c *cache) add(key string, value ByteView, expire time.Time, delta time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
 		return
 	}
+	c.initLocked()
 
-	if v, ok := c.lru.Get(key); ok {
-		return v.(ByteView), ok
+	it := newItem(value, time.Now())
+	if c.ring == nil {
+		c.lru.AddWithDelta(key, it, expire, delta)
+		return
 	}
 
+	// 先删掉旧值的chunk, 再写入新chunk, 最后覆盖manifest
+	if old, _, ok := c.loadLocked(key, false); ok {
+		c.removeChunksLocked(key, old.chunks)
+	}
+	if n := len(value.b); n > c.chunkSize {
+		for i := 0; i*c.chunkSize < n; i++ {
+			chunk := value.b[i*c.chunkSize : min((i+1)*c.chunkSize, n)]
+			if !c.ring.Set(chunkKey(key, i), encodeItem(item{ByteView: ByteView{b: chunk}, version: uint64(checksum(chunk))}), expire, 0) {
+				// 放不下, 旧值的chunk已经删了, manifest也一起删掉
+				c.removeChunksLocked(key, it.chunks)
+				c.ring.Remove(ringKey(key))
+				return
+			}
+			it.chunks++
+		}
+		it.ByteView = ByteView{}
+	}
+	if !c.ring.Set(ringKey(key), encodeItem(it), expire, delta) {
+		// 例如key超过了ringcache.MaxKeyLen, 旧的manifest已被Set删除
+		c.removeChunksLocked(key, it.chunks)
+	}
+}
+
+// initLocked lazily creates the storage
+func (c *cache) initLocked() {
+	if c.storage == StorageRing {
+		if c.ring == nil {
+			// 环形缓冲区在第一次写入时一次性分配
+			c.ring = ringcache.New(c.cacheBytes, ringcache.Options{})
+			c.ring.OnEvicted = func(key string) {
+				// 只统计和通知value的淘汰, chunk不算
+				if key[0] == ringValuePrefix {
+					c.evicted(key[1:])
+				}
+			}
+			c.ring.Beta = c.beta
+			c.ring.FIFO = c.policy == EvictFIFO
+			// 每个chunk都要放得进一个shard
+			c.chunkSize = max(min(defaultChunkSize, c.ring.MaxEntryLen()/4), 1)
+		}
+		return
+	}
+	if c.lru == nil {
+		// Lazy Initialization
+		c.lru = lru.New(c.cacheBytes, func(key string, _ item) {
+			c.evicted(key)
+		})
+		c.lru.Sizer = itemSize
+		c.lru.Beta = c.beta
+		c.lru.MaxEntries = c.maxEntries
+		c.lru.FIFO = c.policy == EvictFIFO
+		c.lru.EntryOverhead = c.overhead
+	}
+}
+
+// loadLocked looks up the item stored for key, which is a manifest if
+// it.chunks > 0. promote marks it as used like Get, otherwise it is a Peek
+func (c *cache) loadLocked(key string, promote bool) (it item, expire time.Time, ok bool) {
+	return c.loadRawLocked(ringKey(key), key, promote)
+}
+
+// loadRawLocked looks up an item under its ringcache key rk, or key in lru
+func (c *cache) loadRawLocked(rk, key string, promote bool) (it item, expire time.Time, ok bool) {
+	switch {
+	case c.ring != nil && promote:
+		var b []byte
+		if b, ok = c.ring.Get(rk); ok {
+			it = decodeItem(b)
+		}
+	case c.ring != nil:
+		var b []byte
+		if b, expire, ok = c.ring.Peek(rk); ok {
+			it = decodeItem(b)
+		}
+	case c.lru != nil && promote:
+		it, ok = c.lru.Get(key)
+	case c.lru != nil:
+		it, expire, ok = c.lru.Peek(key)
+	}
+	return
+}
+
+func (c *cache) deleteLocked(key string) {
+	if c.ring != nil {
+		c.ring.Remove(ringKey(key))
+	}
+	if c.lru != nil {
+		c.lru.Remove(key)
+	}
+}
+
+// evicted is called with c.mu held when key leaves the cache
+func (c *cache) evicted(key string) {
+	c.nevict++
+	if c.onEvicted != nil {
+		c.onEvicted(key)
+	}
+}
+
+// assembleLocked joins the chunks of manifest it, it reports false if
+// a chunk is missing or does not match its checksum. ringcache copies
+// values out anyway, each chunk is copied once more into the result.
+func (c *cache) assembleLocked(key string, it item, promote bool) (ByteView, bool) {
+	b := make([]byte, 0, it.chunks*c.chunkSize)
+	for i := 0; i < it.chunks; i++ {
+		chunk, _, ok := c.loadRawLocked(chunkKey(key, i), "", promote)
+		if !ok || uint64(checksum(chunk.b)) != chunk.version {
+			return ByteView{}, false
+		}
+		b = append(b, chunk.b...)
+	}
+	return ByteView{b: b}, true
+}
+
+func (c *cache) get(key string) (value ByteView, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nget++
+	it, _, ok := c.loadLocked(key, true)
+	if !ok {
+		return
+	}
+	if it.chunks > 0 {
+		if it.ByteView, ok = c.assembleLocked(key, it, true); !ok {
+			// 有chunk被淘汰了, 整个值作废
+			c.removeLocked(key)
+			return
+		}
+	}
+	c.nhit++
+	return it.view(), true
+}
+
+func (c *cache) peek(key string) (it item, expire time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if it, expire, ok = c.loadLocked(key, false); !ok {
+		return
+	}
+	if it.chunks > 0 {
+		if it.ByteView, ok = c.assembleLocked(key, it, false); !ok {
+			return item{}, time.Time{}, false
+		}
+	}
+	it.ByteView = it.view()
 	return
 }
+
+func (c *cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+// removeLocked removes key and its chunks, if any
+func (c *cache) removeLocked(key string) {
+	it, _, ok := c.loadLocked(key, false)
+	c.deleteLocked(key)
+	if ok {
+		c.removeChunksLocked(key, it.chunks)
+	}
+}
+
+func (c *cache) removeChunksLocked(key string, chunks int) {
+	for i := 0; i < chunks; i++ {
+		c.ring.Remove(chunkKey(key, i))
+	}
+}
+
+// removeOldest evicts the entry the cache would evict next,
+// it reports whether there was one
+func (c *cache) removeOldest() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring != nil {
+		return c.ring.RemoveOldest()
+	}
+	if c.lru == nil || c.lru.Len() == 0 {
+		return false
+	}
+	c.lru.RemoveOldest()
+	return true
+}
+
+func (c *cache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring != nil {
+		c.ring.Clear()
+	}
+	if c.lru != nil {
+		c.lru.Purge()
+	}
+}
+
+// close frees the cache, later adds are ignored
+func (c *cache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.lru = nil
+	c.ring = nil
+}
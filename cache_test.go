@@ -0,0 +1,47 @@
+package dcache
+
+import (
+	"dcache/lru"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// overheadEntries is large enough for the map's growth steps to average out
+const overheadEntries = 1 << 17
+
+// BenchmarkEntryOverhead measures the heap each entry of the lru a cache
+// stores items in takes besides its key bytes, and checks
+// defaultEntryOverhead against it.
+//
+//	go test -run=^$ -bench=EntryOverhead
+func BenchmarkEntryOverhead(b *testing.B) {
+	keys := make([]string, overheadEntries)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	var per float64
+	for n := 0; n < b.N; n++ {
+		before := heapAlloc()
+		c := lru.New[string, item](0, nil)
+		for _, k := range keys {
+			c.Add(k, item{}, time.Time{})
+		}
+		per = float64(heapAlloc()-before) / overheadEntries
+		runtime.KeepAlive(c)
+	}
+	b.ReportMetric(per, "B/entry")
+	b.ReportMetric(float64(defaultEntryOverhead), "B/estimated")
+	// 估计值不能偏离实测超过1/4, 否则CacheBytes就不再约束实际内存
+	if got := float64(defaultEntryOverhead); got < per*3/4 || got > per*5/4 {
+		b.Errorf("EntryOverhead = %d, measured %.1f bytes per entry", defaultEntryOverhead, per)
+	}
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
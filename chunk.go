@@ -0,0 +1,34 @@
+package dcache
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+/*
+大value的传输. gRPC通过GetStream分块发送, 第一块带上总长度和校验和;
+HTTP的原始格式在header中带上长度和校验和, 大value用chunked编码分块写出.
+接收方边收边计算CRC-32C, 与发送方不一致时返回ErrChecksum.
+*/
+
+// ErrChecksum is returned when a value received from a peer does not
+// match the checksum the peer sent with it.
+var ErrChecksum = errors.New("dcache: checksum mismatch")
+
+// transferChunkSize is how many bytes of a value are sent at once
+const transferChunkSize = 1 << 20
+
+// maxPrealloc bounds the buffer allocated upfront for the size a peer
+// announces, larger values grow as they arrive
+const maxPrealloc = 64 << 20
+
+const (
+	checksumHeader = "X-Dcache-Checksum"
+	sizeHeader     = "X-Dcache-Size"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(b []byte) uint32 {
+	return crc32.Checksum(b, castagnoli)
+}
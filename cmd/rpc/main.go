@@ -16,14 +16,18 @@ var db = map[string]string{
 }
 
 func createGroup() *dcache.Group {
-	return dcache.NewGroup("scores", 2<<10, dcache.GetterFunc(
+	g, err := dcache.NewGroup("scores", dcache.GetterFunc(
 		func(key string) ([]byte, error) {
 			log.Println("[SlowDB] search key", key)
 			if v, ok := db[key]; ok {
 				return []byte(v), nil
 			}
-			return nil, fmt.Errorf("%s not exist", key)
-		}))
+			return nil, fmt.Errorf("%s not exist: %w", key, dcache.ErrNotFound)
+		}), dcache.WithCacheBytes(2<<10))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return g
 }
 
 func startCacheServerGrpc(addr string, addrs []string, g *dcache.Group) {
@@ -38,7 +42,7 @@ func startAPIServer(apiAddr string, g *dcache.Group) {
 	http.Handle("/api", http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			key := r.URL.Query().Get("key")
-			view, err := g.Get(key, time.Time(time.Unix(0, 0)))
+			view, err := g.Get(r.Context(), key, time.Time{})
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -0,0 +1,204 @@
+package dcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+value压缩. 开启后populateCache把超过阈值的value压缩后再放入cache, 字节预算按压缩后的大小计算.
+压缩后的字节在节点间原样传输, 只有调用方读取ByteView时才解压, 解压结果只属于这个ByteView.
+从peer收到的压缩数据不做校验直接放入hotCache, 转发给其它peer时也不解压;
+Group.Get在返回给调用方之前解压校验, 失败时返回错误并丢弃hotCache中的副本.
+*/
+
+// Compression is how a group compresses the values it caches. The values
+// are part of the peer protocol and must not change.
+type Compression int
+
+const (
+	CompressNone  Compression = 0
+	CompressGzip  Compression = 1
+	CompressFlate Compression = 2
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressNone:
+		return "none"
+	case CompressGzip:
+		return "gzip"
+	case CompressFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// parseCompression is the inverse of String
+func parseCompression(s string) (Compression, bool) {
+	for _, c := range []Compression{CompressNone, CompressGzip, CompressFlate} {
+		if c.String() == s {
+			return c, true
+		}
+	}
+	return CompressNone, false
+}
+
+// HTTPPool sends values compressed only to clients asking for it
+const (
+	acceptCompressedHeader = "X-Dcache-Accept-Compressed"
+	compressionHeader      = "X-Dcache-Compression"
+)
+
+// defaultCompressThreshold is the smallest value compressed by default,
+// shorter ones rarely get smaller
+const defaultCompressThreshold = 1 << 10
+
+// maxInflated bounds the decompressed size of a value, so that a small
+// compressed value from a peer can not exhaust the memory
+const maxInflated = 1 << 30
+
+// ErrCorruptValue is returned when a compressed value from a peer does not
+// decompress.
+var ErrCorruptValue = errors.New("dcache: corrupt compressed value")
+
+// inflated decompresses the bytes of a ByteView once, on first read
+type inflated struct {
+	c      Compression
+	remote bool // received from a peer and not checked yet
+	once   sync.Once
+	b      []byte
+	err    error
+}
+
+// compressedView returns a view of b compressed with c by this node
+func compressedView(b []byte, c Compression) ByteView {
+	if c == CompressNone {
+		return ByteView{b: b}
+	}
+	return ByteView{b: b, z: &inflated{c: c}}
+}
+
+// remoteView returns a view of b, received from a peer compressed with c.
+// It is checked when it is first read, see read.
+func remoteView(b []byte, c Compression) ByteView {
+	v := compressedView(b, c)
+	if v.z != nil {
+		v.z.remote = true
+	}
+	return v
+}
+
+// read returns the uncompressed bytes of v, or ErrCorruptValue if they
+// do not decompress
+func (v ByteView) read() ([]byte, error) {
+	if v.z == nil {
+		return v.b, nil
+	}
+	v.z.once.Do(func() {
+		b, err := decompress(v.z.c, v.b)
+		if err != nil {
+			v.z.err = fmt.Errorf("%w: %v: %v", ErrCorruptValue, v.z.c, err)
+			return
+		}
+		v.z.b = b
+	})
+	return v.z.b, v.z.err
+}
+
+// data returns the uncompressed bytes of v. Values of this node always
+// decompress and Group.Get checks those of peers before returning them,
+// so a failure means the memory is corrupt.
+func (v ByteView) data() []byte {
+	b, err := v.read()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// unchecked reports whether v was received from a peer and not read yet
+func (v ByteView) unchecked() bool {
+	return v.z != nil && v.z.remote
+}
+
+// compression returns how the bytes of v are compressed
+func (v ByteView) compression() Compression {
+	if v.z == nil {
+		return CompressNone
+	}
+	return v.z.c
+}
+
+// compressView compresses v with c if it is at least threshold bytes long
+// and gets smaller. The returned view reads the original bytes without
+// decompressing them.
+func compressView(v ByteView, c Compression, threshold int) ByteView {
+	if c == CompressNone || v.z != nil || len(v.b) < threshold {
+		return v
+	}
+	b, err := compress(c, v.b)
+	if err != nil || len(b) >= len(v.b) {
+		return v
+	}
+	z := &inflated{c: c}
+	z.once.Do(func() { z.b = v.b })
+	return ByteView{b: b, z: z}
+}
+
+func compress(c Compression, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c {
+	case CompressGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressFlate:
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return nil, fmt.Errorf("dcache: unknown compression %v", c)
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(c Compression, b []byte) ([]byte, error) {
+	var r io.ReadCloser
+	switch c {
+	case CompressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case CompressFlate:
+		r = flate.NewReader(bytes.NewReader(b))
+	default:
+		return nil, fmt.Errorf("dcache: unknown compression %v", c)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, maxInflated+1))
+	if err == nil && len(b) > maxInflated {
+		return nil, fmt.Errorf("decompressed size over %d bytes", maxInflated)
+	}
+	return b, err
+}
+
+// wire returns the bytes to send v to a client, compressed as they are
+// stored if the client accepts it
+func (v ByteView) wire(acceptCompressed bool) ([]byte, Compression, error) {
+	if acceptCompressed {
+		return v.b, v.compression(), nil
+	}
+	b, err := v.read()
+	return b, CompressNone, err
+}
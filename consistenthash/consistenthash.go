@@ -59,3 +59,55 @@ func (m *Map) Get(key string) string {
 
 	return m.hashMap[m.keys[idx%len(m.keys)]] // 当idx == len(m.keys)时, 应该是第0个peer, 因此%操作
 }
+
+// GetN returns up to n distinct real nodes for key, walking the ring
+// clockwise from the key's position. The first one is the owner returned by Get.
+func (m *Map) GetN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
+
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(m.keys) && len(nodes) < n; i++ {
+		node := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Distribution describes how much of the ring a real node owns.
+type Distribution struct {
+	VNodes int     `json:"vnodes"` // virtual nodes on the ring
+	Share  float64 `json:"share"`  // fraction of the hash space owned
+}
+
+// Distribution returns the ring's virtual-node distribution per real node.
+func (m *Map) Distribution() map[string]Distribution {
+	dist := make(map[string]Distribution)
+	if len(m.keys) == 0 {
+		return dist
+	}
+	const space = float64(1 << 32)
+	for i, hash := range m.keys {
+		// 每个虚节点负责(前一个虚节点, 自己]这段哈希空间, 第一个虚节点跨过环的起点
+		prev := m.keys[len(m.keys)-1] - (1 << 32)
+		if i > 0 {
+			prev = m.keys[i-1]
+		}
+		node := m.hashMap[hash]
+		d := dist[node]
+		d.VNodes++
+		d.Share += float64(hash-prev) / space
+		dist[node] = d
+	}
+	return dist
+}
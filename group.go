@@ -1,11 +1,16 @@
 package dcache
 
 import (
+	"context"
+	"dcache/limiter"
 	"dcache/pb"
 	"dcache/singleflight"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,39 +28,138 @@ func (f GetterFunc) Get(key string) ([]byte, error) {
 	return f(key)
 }
 
+// ErrNotFound should be wrapped by a Getter's error when the key does not
+// exist, so that servers can answer HTTP 404 and gRPC NotFound.
+var ErrNotFound = errors.New("dcache: not found")
+
+// ErrOverloaded is returned when a Group's load limiter rejects a request,
+// or the key's owner rejected it. Servers map it to HTTP 503 and gRPC
+// ResourceExhausted.
+var ErrOverloaded = errors.New("dcache: overloaded")
+
 // A Group is a cache namespace and associated data loaded spread over
 type Group struct {
-	name      string
-	getter    Getter
+	name   string
+	getter Getter
+	config GroupConfig
+	// mainCache holds the keys this node owns or loaded itself
 	mainCache cache
-	peers     PeerPicker
+	// hotCache holds some of the values loaded from peers, so that hot keys
+	// don't cost a network hop on every Get
+	hotCache cache
+	// negCache remembers keys that were not found, see GroupConfig.NegativeTTL
+	negCache cache
+	peers    PeerPicker
 	// use singleflight.Group to make sure that
 	// each key is only fetched once
 	loader *singleflight.Group
+	// leases arbitrates loads of keys whose owner is down, see lease.go
+	leases leaseTable
+	// hedger races slow peer requests against a local load, nil disables it
+	hedger *hedger
+	// limiter bounds concurrent getter.Get calls, nil means unlimited
+	limiter limiter.Limiter
+
+	// Stats are statistics on the group.
+	Stats Stats
+
+	registry  *Registry
+	closeOnce sync.Once
+	done      chan struct{} // closed by Close
 }
 
-var (
-	mu     sync.RWMutex
-	groups = make(map[string]*Group)
-)
+// Stats are per-group statistics.
+type Stats struct {
+	Gets           AtomicInt // any Get request, including from peers
+	CacheHits      AtomicInt // cache was good
+	PeerLoads      AtomicInt // remote load (not an error)
+	PeerErrors     AtomicInt
+	Loads          AtomicInt // (gets - cacheHits)
+	LoadsDeduped   AtomicInt // after singleflight
+	LocalLoads     AtomicInt // total good local loads
+	LocalLoadErrs  AtomicInt // total bad local loads
+	ServerRequests AtomicInt // gets that came over the network from peers
+}
 
-// NewGroup create a new instance of Group
-func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
-	if getter == nil {
-		panic("nil Getter")
-	}
-	mu.Lock()
-	defer mu.Unlock()
+// An AtomicInt is an int64 to be accessed atomically.
+type AtomicInt int64
+
+// Add atomically adds n to i.
+func (i *AtomicInt) Add(n int64) {
+	atomic.AddInt64((*int64)(i), n)
+}
+
+// Get atomically gets the value of i.
+func (i *AtomicInt) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+func (i *AtomicInt) String() string {
+	return strconv.FormatInt(i.Get(), 10)
+}
+
+// MarshalJSON encodes i as a JSON number.
+func (i *AtomicInt) MarshalJSON() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// maxNegativeEntries bounds the number of keys remembered as not found
+const maxNegativeEntries = 1 << 12
+
+func newGroup(name string, getter Getter, config GroupConfig) *Group {
 	g := &Group{
-		name:      name,
-		getter:    getter,
-		mainCache: cache{cacheBytes: cacheBytes},
-		loader:    &singleflight.Group{},
+		name:   name,
+		getter: getter,
+		config: config,
+		loader: &singleflight.Group{},
+		done:   make(chan struct{}),
+	}
+	hotBytes, hotEntries := int64(0), 0
+	if config.HotCacheRatio > 0 {
+		if config.CacheBytes > 0 {
+			hotBytes = max(int64(float64(config.CacheBytes)*config.HotCacheRatio), 1)
+		}
+		if config.MaxEntries > 0 {
+			hotEntries = max(int(float64(config.MaxEntries)*config.HotCacheRatio), 1)
+		}
+	}
+	g.mainCache = cache{
+		cacheBytes: config.CacheBytes - hotBytes,
+		maxEntries: config.MaxEntries - hotEntries,
+		policy:     config.Eviction,
+		storage:    config.Storage,
+		beta:       config.EarlyExpiration,
+		onEvicted:  config.Hooks.OnEvict,
+		overhead:   config.EntryOverhead,
+	}
+	g.hotCache = cache{
+		cacheBytes: hotBytes,
+		maxEntries: hotEntries,
+		policy:     config.Eviction,
+		storage:    config.Storage,
+		beta:       config.EarlyExpiration,
+		overhead:   config.EntryOverhead,
+	}
+	g.negCache = cache{maxEntries: maxNegativeEntries, overhead: config.EntryOverhead}
+	g.limiter = config.LoadLimiter
+	if config.LoadConcurrency > 0 {
+		g.limiter = limiter.NewFixed(config.LoadConcurrency, config.LoadQueue)
+	}
+	if config.Hedging.Percentile > 0 {
+		g.hedger = newHedger(config.Hedging)
 	}
-	groups[name] = g
 	return g
 }
 
+// Config returns the configuration g was created with.
+func (g *Group) Config() GroupConfig {
+	return g.config
+}
+
+func (g *Group) logf(format string, v ...interface{}) {
+	g.config.Logger.Printf(format, v...)
+}
+
 // RegisterPeers registers a PeerPicker for choosing remote peer
 func (g *Group) RegisterPeers(peers PeerPicker) {
 	if g.peers != nil {
@@ -64,44 +168,198 @@ func (g *Group) RegisterPeers(peers PeerPicker) {
 	g.peers = peers
 }
 
-// GetGroup returns the named group previously created with NewGroup, or
-// nil if there's no such group.
-func GetGroup(name string) *Group {
-	mu.RLock()
-	g := groups[name]
-	mu.RUnlock()
-	return g
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// CacheStats returns stats about the group's main cache.
+func (g *Group) CacheStats() CacheStats {
+	return g.mainCache.stats()
+}
+
+// HotCacheStats returns stats about the group's hot cache of values
+// owned by peers.
+func (g *Group) HotCacheStats() CacheStats {
+	return g.hotCache.stats()
+}
+
+// Close removes g from its registry, frees its cache and stops its
+// background goroutines. Gets on a closed group fail with ErrGroupClosed.
+// Close is idempotent and always returns nil.
+func (g *Group) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.done)
+		g.registry.remove(g)
+		if g.config.Memory != nil {
+			g.config.Memory.unregister(g)
+		}
+		g.mainCache.close()
+		g.hotCache.close()
+		g.negCache.close()
+	})
+	return nil
+}
+
+// closed reports whether g has been closed
+func (g *Group) closed() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get value for a key from cache.
+// ctx only bounds how long this caller waits, a load shared with other
+// callers keeps running until all of them have given up.
+// A compressed value from a peer that does not decompress is dropped and
+// ErrCorruptValue returned.
+func (g *Group) Get(ctx context.Context, key string, expire time.Time) (ByteView, error) {
+	value, err := g.get(ctx, key, expire)
+	if err == nil && value.unchecked() {
+		// 调用方马上就要读取, 在这里解压校验, 解压结果留在value中
+		if _, err = value.read(); err != nil {
+			return ByteView{}, g.dropCorrupt(key, err)
+		}
+	}
+	return value, err
+}
+
+// dropCorrupt removes the peer copy of key that failed to decompress
+// with err, and returns err
+func (g *Group) dropCorrupt(key string, err error) error {
+	g.logf("[DCache] dropping %s: %v", key, err)
+	g.hotCache.remove(key)
+	return err
 }
 
-// Get value for a key from cache
-func (g *Group) Get(key string, expire time.Time) (ByteView, error) {
+// get is Get without checking values from peers, for serving them to
+// other peers as they are
+func (g *Group) get(ctx context.Context, key string, expire time.Time) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
+	if g.closed() {
+		return ByteView{}, ErrGroupClosed
+	}
 
-	if v, ok := g.mainCache.get(key); ok {
-		log.Println("[DCache] hit")
+	g.Stats.Gets.Add(1)
+	if v, ok := g.lookupCache(key); ok {
+		g.logf("[DCache] hit")
+		g.Stats.CacheHits.Add(1)
+		if g.config.Hooks.OnHit != nil {
+			g.config.Hooks.OnHit(key)
+		}
 		return v, nil
 	}
+	if _, ok := g.negCache.get(key); ok {
+		g.Stats.CacheHits.Add(1)
+		return ByteView{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
 
 	// 缓存未命中
-	return g.load(key, expire)
+	g.Stats.Loads.Add(1)
+	if g.config.Hooks.OnMiss != nil {
+		g.config.Hooks.OnMiss(key)
+	}
+	value, err := g.load(ctx, key, g.expireOrDefault(expire))
+	if errors.Is(err, ErrNotFound) && g.config.NegativeTTL > 0 {
+		g.negCache.add(key, ByteView{}, time.Now().Add(g.config.NegativeTTL), 0)
+	}
+	return value, err
 }
 
-func (g *Group) load(key string, expire time.Time) (value ByteView, err error) {
+func (g *Group) lookupCache(key string) (ByteView, bool) {
+	if v, ok := g.mainCache.get(key); ok {
+		return v, true
+	}
+	if v, ok := g.hotCache.get(key); ok {
+		return remoteView(v.b, v.compression()), true
+	}
+	return ByteView{}, false
+}
+
+// expireOrDefault applies the default TTL to a zero expire time
+func (g *Group) expireOrDefault(expire time.Time) time.Time {
+	if expire.IsZero() && g.config.DefaultTTL > 0 {
+		return time.Now().Add(g.config.DefaultTTL)
+	}
+	return expire
+}
+
+// Set stores value for key in this node's cache, a zero expire uses the
+// default TTL.
+func (g *Group) Set(key string, value []byte, expire time.Time) {
+	g.populateCache(key, ByteView{b: cloneBytes(value)}, g.expireOrDefault(expire), 0)
+}
+
+// Remove invalidates key in this node's cache.
+func (g *Group) Remove(key string) {
+	g.mainCache.remove(key)
+	g.hotCache.remove(key)
+	g.negCache.remove(key)
+}
+
+// cacheBytes is the size of g's main and hot caches
+func (g *Group) cacheBytes() int64 {
+	return g.mainCache.bytes() + g.hotCache.bytes()
+}
+
+// evictOldest evicts one entry, from the hot cache first as those values
+// can be fetched again from their owner. It reports whether there was one.
+func (g *Group) evictOldest() bool {
+	return g.hotCache.removeOldest() || g.mainCache.removeOldest()
+}
+
+// flush empties this node's caches of g
+func (g *Group) flush() {
+	g.mainCache.clear()
+	g.hotCache.clear()
+	g.negCache.clear()
+}
+
+// peek returns the cached value and its expire time without loading it
+func (g *Group) peek(key string) (item, time.Time, bool) {
+	if it, expire, ok := g.mainCache.peek(key); ok {
+		return it, expire, ok
+	}
+	return g.hotCache.peek(key)
+}
+
+func (g *Group) load(ctx context.Context, key string, expire time.Time) (value ByteView, err error) {
 	// each key is only fetched once (either locally or remotely)
 	// regardless of the number of concurrent callers.
-	viewi, err := g.loader.Do(key, func() (interface{}, error) {
+	viewi, err, _ := g.loader.DoContext(ctx, key, func(ctx context.Context) (interface{}, error) {
+		g.Stats.LoadsDeduped.Add(1)
 		if g.peers != nil {
 			if peer, ok := g.peers.PickPeer(key); ok {
-				if value, err = g.getFromPeer(peer, key); err == nil {
-					return value, nil
+				start := time.Now()
+				value, local, err := g.getFromPeerHedged(ctx, peer, key, expire)
+				if err == nil && !local {
+					g.Stats.PeerLoads.Add(1)
+					// 和groupcache一样, 只有一部分peer的值进入hotCache, 避免挤占
+					// 取值耗时作为XFetch的delta, 让hotCache也能提前过期
+					if g.config.HotCacheRatio > 0 && rand.Intn(10) == 0 {
+						g.hotCache.add(key, value, g.jitter(expire), time.Since(start))
+					}
+				}
+				// owner在限流时本地加载只会把压力转移到数据源, 直接返回ErrOverloaded
+				if err == nil || local || errors.Is(err, ErrNotFound) || errors.Is(err, ErrOverloaded) {
+					return value, err
+				}
+				g.Stats.PeerErrors.Add(1)
+				g.logf("[DCache] Failed to get from peer %v", err)
+				if g.config.LeaseWait > 0 {
+					if fp, ok := g.peers.(FallbackPicker); ok {
+						return g.loadWithFallback(ctx, fp, key, expire)
+					}
 				}
-				log.Println("[DCache] Failed to get from peer", err)
 			}
 		}
 
-		return g.getLocally(key, expire)
+		return g.getLocally(ctx, key, expire)
 	})
 
 	if err == nil {
@@ -110,40 +368,84 @@ func (g *Group) load(key string, expire time.Time) (value ByteView, err error) {
 	return
 }
 
+// owner不可达时, 经由fallback节点的lease协调加载
+func (g *Group) loadWithFallback(ctx context.Context, fp FallbackPicker, key string, expire time.Time) (ByteView, error) {
+	peer, ok := fp.PickFallback(key)
+	if !ok {
+		return g.loadWithLease(ctx, nil, key, expire)
+	}
+	if lg, ok := peer.(LeaseGetter); ok {
+		return g.loadWithLease(ctx, lg, key, expire)
+	}
+	return g.getLocally(ctx, key, expire)
+}
+
 // 从Getter中Get(key)
-func (g *Group) getLocally(key string, expire time.Time) (ByteView, error) {
+func (g *Group) getLocally(ctx context.Context, key string, expire time.Time) (ByteView, error) {
+	if g.limiter != nil {
+		release, err := g.limiter.Acquire(ctx)
+		if errors.Is(err, limiter.ErrLimitExceeded) {
+			return ByteView{}, ErrOverloaded
+		}
+		if err != nil {
+			return ByteView{}, err
+		}
+		defer release()
+	}
+
+	start := time.Now()
 	bytes, err := g.getter.Get(key)
+	if g.config.Hooks.OnLoad != nil {
+		g.config.Hooks.OnLoad(key, time.Since(start), err)
+	}
 	if err != nil {
+		g.Stats.LocalLoadErrs.Add(1)
 		return ByteView{}, err
 	}
+	g.Stats.LocalLoads.Add(1)
 
-	value := ByteView{b: cloneBytes(bytes)}
-	// 添加到cache中
-	g.populateCache(key, value, expire)
-	return value, nil
+	// 添加到cache中, 记录加载耗时供XFetch使用
+	return g.populateCache(key, ByteView{b: cloneBytes(bytes)}, expire, time.Since(start)), nil
 }
 
-func (g *Group) populateCache(key string, value ByteView, expire time.Time) {
-	g.mainCache.add(key, value, expire)
+// populateCache adds value to the main cache, compressed if the group is
+// configured to, and returns the view that was cached
+func (g *Group) populateCache(key string, value ByteView, expire time.Time, delta time.Duration) ByteView {
+	value = compressView(value, g.config.Compression, g.config.CompressThreshold)
+	g.negCache.remove(key)
+	g.mainCache.add(key, value, g.jitter(expire), delta)
+	return value
 }
 
-func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
+// jitter moves expire earlier by a random part of the remaining TTL
+func (g *Group) jitter(expire time.Time) time.Time {
+	if g.config.TTLJitter == 0 || expire.IsZero() {
+		return expire
+	}
+	ttl := time.Until(expire)
+	if ttl <= 0 {
+		return expire
+	}
+	return expire.Add(-time.Duration(rand.Float64() * g.config.TTLJitter * float64(ttl)))
+}
+
+func (g *Group) getFromPeer(ctx context.Context, peer PeerGetter, key string) (ByteView, error) {
 	req := &pb.Request{
-		Group: g.name,
-		Key:   key,
+		Group:            g.name,
+		Key:              key,
+		AcceptCompressed: true,
 	}
 	res := &pb.Response{}
-	err := peer.Get(req, res)
+	err := g.config.Retry.do(ctx, func() error {
+		res.Reset()
+		return peer.Get(ctx, req, res)
+	})
 	if err != nil {
 		return ByteView{}, err
 	}
-	return ByteView{b: res.Value}, nil
+	if res.Compression > uint32(CompressFlate) {
+		return ByteView{}, fmt.Errorf("dcache: unknown compression %d from peer", res.Compression)
+	}
+	// 读取时才解压校验, 只放进hotCache或转发给其它peer的值不需要解压
+	return remoteView(res.Value, Compression(res.Compression)), nil
 }
-
-// func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
-// 	bytes, err := peer.Get(g.name, key)
-// 	if err != nil {
-// 		return ByteView{}, err
-// 	}
-// 	return ByteView{b: bytes}, nil
-// }
@@ -0,0 +1,163 @@
+package dcache
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+一个慢节点会拖慢它负责的所有key的p99延迟.
+hedging: 向owner发出请求后, 若超过近期延迟的某个分位数仍未返回, 则在本地并发加载一次,
+取先返回的结果并取消另一个请求. 预算限制保证hedge请求不超过总请求的一定比例.
+这里hedge不发往其它副本节点: 非owner节点收到请求后仍会转发给同一个慢owner, 达不到效果.
+*/
+
+// HedgePolicy configures hedged peer requests.
+type HedgePolicy struct {
+	// Percentile of recent peer latencies after which a hedge is sent, e.g. 0.95
+	Percentile float64
+	// MinDelay and MaxDelay clamp the computed hedge delay, MaxDelay 0 means no upper bound
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// Budget is the max fraction of peer requests that may be hedged, e.g. 0.05
+	Budget float64
+}
+
+const (
+	hedgeSamples    = 256  // peer latencies remembered for the percentile
+	hedgeMinSamples = 20   // no hedging until this many latencies are known
+	hedgeRecompute  = 32   // recompute the delay every this many samples
+	hedgeWindow     = 1000 // request/hedge counters are halved past this many requests
+)
+
+type hedger struct {
+	policy HedgePolicy
+
+	mu       sync.Mutex
+	samples  [hedgeSamples]time.Duration
+	n        int // total samples recorded
+	delay    time.Duration
+	requests float64
+	hedges   float64
+}
+
+func newHedger(policy HedgePolicy) *hedger {
+	return &hedger{policy: policy}
+}
+
+// observe records the latency of a peer request
+func (h *hedger) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.n%hedgeSamples] = d
+	h.n++
+	if h.n == hedgeMinSamples || h.n > hedgeMinSamples && h.n%hedgeRecompute == 0 {
+		h.delay = h.percentile()
+	}
+}
+
+func (h *hedger) percentile() time.Duration {
+	n := min(h.n, hedgeSamples)
+	sorted := make([]time.Duration, n)
+	copy(sorted, h.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	d := sorted[min(int(h.policy.Percentile*float64(n)), n-1)]
+	if d < h.policy.MinDelay {
+		d = h.policy.MinDelay
+	}
+	if h.policy.MaxDelay > 0 && d > h.policy.MaxDelay {
+		d = h.policy.MaxDelay
+	}
+	return d
+}
+
+// start counts a peer request and returns the hedge delay,
+// ok is false while there are not enough samples yet
+func (h *hedger) start() (delay time.Duration, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests++
+	if h.requests > hedgeWindow {
+		h.requests /= 2
+		h.hedges /= 2
+	}
+	return h.delay, h.n >= hedgeMinSamples
+}
+
+// allow reports whether one more hedge fits in the budget
+func (h *hedger) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hedges+1 > h.policy.Budget*h.requests {
+		return false
+	}
+	h.hedges++
+	return true
+}
+
+type hedgeResult struct {
+	value ByteView
+	err   error
+	local bool
+}
+
+// getFromPeerHedged gets key from peer, racing it against a local load
+// once the hedge delay has passed. local reports whether the value was
+// loaded locally, or for an error whether a local load was made, so that
+// the caller does not load again.
+func (g *Group) getFromPeerHedged(ctx context.Context, peer PeerGetter, key string, expire time.Time) (value ByteView, local bool, err error) {
+	h := g.hedger
+	if h == nil {
+		value, err = g.getFromPeer(ctx, peer, key)
+		return value, false, err
+	}
+
+	delay, ok := h.start()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 取消还未返回的peer请求
+
+	ch := make(chan hedgeResult, 2)
+	begin := time.Now()
+	go func() {
+		value, err := g.getFromPeer(ctx, peer, key)
+		if err == nil {
+			h.observe(time.Since(begin))
+		}
+		ch <- hedgeResult{value: value, err: err}
+	}()
+	if !ok {
+		r := <-ch
+		return r.value, false, r.err
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.value, false, r.err
+	case <-timer.C:
+	}
+	if !h.allow() {
+		r := <-ch
+		return r.value, false, r.err
+	}
+
+	go func() {
+		value, err := g.getLocally(ctx, key, expire)
+		ch <- hedgeResult{value: value, err: err, local: true}
+	}()
+	// 取第一个成功的结果, 都失败时优先返回本地加载的错误
+	var last hedgeResult
+	for range 2 {
+		r := <-ch
+		if r.err == nil {
+			return r.value, r.local, nil
+		}
+		if !last.local {
+			last = r
+		}
+	}
+	return last.value, true, last.err
+}
@@ -1,139 +1,926 @@
 package dcache
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"dcache/consistenthash"
 	"dcache/pb"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/protobuf/proto"
 )
 
 const (
-	defaultBasePath = "/_dcache_/"
-	defaultReplicas = 50
+	defaultBasePath     = "/_dcache_/"
+	defaultReplicas     = 50
+	defaultMaxBodyBytes = 64 << 20
 )
 
+// media types served by HTTPPool, protobuf is used between peers
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeRaw      = "application/octet-stream"
+	contentTypeJSON     = "application/json"
+)
+
+// defaultTransport pools keep-alive connections to peers, http.DefaultTransport
+// keeps only 2 idle connections per host which is far too few for peer traffic.
+var defaultTransport http.RoundTripper = NewTransport()
+
+// NewTransport returns an HTTP/1.1 transport tuned for peer traffic.
+func NewTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 1024
+	t.MaxIdleConnsPerHost = 128
+	t.IdleConnTimeout = 90 * time.Second
+	return t
+}
+
+// NewH2CTransport returns a transport speaking HTTP/2 over cleartext TCP (h2c),
+// which multiplexes all requests to a peer on one connection.
+// Peers must serve HTTPPool.H2CHandler.
+func NewH2CTransport() http.RoundTripper {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
 type HTTPPool struct {
+	// Transport optionally specifies an http.RoundTripper for the client
+	// to use when it makes a request to a peer.
+	// If nil, a transport from NewTransport is used.
+	Transport func(context.Context) http.RoundTripper
+	// Timeout bounds each request to a peer, 0 means no timeout.
+	Timeout time.Duration
+	// Header optionally returns headers added to every request to a peer,
+	// e.g. tracing or auth headers.
+	Header func(context.Context) http.Header
+
 	// this peer's base URL, e.g. "https://example.net:8000"
-	self        string     // addr host + port
-	basePath    string     // url prefix /<basepath>/<groupname>/<key>
+	self        string // addr host + port
+	opts        HTTPPoolOptions
 	mu          sync.Mutex // guards peers and httpGetters
 	peers       *consistenthash.Map
 	httpGetters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
 }
 
+// HTTPPoolOptions are the configurations of a HTTPPool.
+type HTTPPoolOptions struct {
+	// BasePath specifies the HTTP path that will serve dcache requests,
+	// a "/" is appended if it does not end with one.
+	// If blank, it defaults to "/_dcache_/".
+	BasePath string
+
+	// AdminPath specifies the HTTP path of AdminHandler. If blank, it is
+	// BasePath ending in "_admin/", e.g. "/_dcache_admin/" for "/_dcache_/".
+	AdminPath string
+
+	// Replicas specifies the number of key replicas on the consistent hash.
+	// If blank, it defaults to 50.
+	Replicas int
+
+	// HashFn specifies the hash function of the consistent hash.
+	// If blank, it defaults to crc32.ChecksumIEEE.
+	HashFn consistenthash.Hash
+
+	// Transport sets HTTPPool.Transport.
+	Transport func(context.Context) http.RoundTripper
+
+	// TLS enables mutual TLS to peers: if Transport is blank, requests use
+	// a transport dialing with TLS.DialTLSContext. Peers must be "https://"
+	// URLs and serve with an http.Server whose TLSConfig is TLS.ServerConfig().
+	TLS *PeerTLS
+
+	// Auth signs requests to peers and verifies requests from peers.
+	// If nil, requests are not authenticated.
+	Auth Authenticator
+
+	// Registry holds the groups the pool serves.
+	// If nil, it defaults to DefaultRegistry.
+	Registry *Registry
+
+	// ACL restricts the operations each identity may perform per group.
+	// If nil, every request is allowed.
+	ACL *ACL
+
+	// PeerIdentities are the identities the cluster's nodes authenticate
+	// as, only their requests may mark a write as sent by a peer. If blank,
+	// it is the identity Auth signs with for HMACAuth and BearerAuth. With
+	// TLS and a TrustDomain, every member of the domain is a peer too.
+	PeerIdentities []string
+
+	// MaxBodyBytes bounds the body of a request, larger ones are answered
+	// with 413. If blank, it defaults to 64MB.
+	MaxBodyBytes int64
+}
+
 // NewHTTPPool initializes an HTTP pool of peers.
 func NewHTTPPool(self string) *HTTPPool {
-	return &HTTPPool{
-		self:     self,
-		basePath: defaultBasePath,
+	return NewHTTPPoolOpts(self, nil)
+}
+
+// NewHTTPPoolOpts initializes an HTTP pool of peers with the given options.
+func NewHTTPPoolOpts(self string, o *HTTPPoolOptions) *HTTPPool {
+	p := &HTTPPool{self: self}
+	if o != nil {
+		p.opts = *o
+	}
+	if p.opts.BasePath == "" {
+		p.opts.BasePath = defaultBasePath
+	}
+	if !strings.HasSuffix(p.opts.BasePath, "/") {
+		// group名直接拼在BasePath后面, 必须以"/"结尾
+		p.opts.BasePath += "/"
+	}
+	if p.opts.AdminPath == "" {
+		p.opts.AdminPath = adminPath(p.opts.BasePath)
+	}
+	if p.opts.Replicas == 0 {
+		p.opts.Replicas = defaultReplicas
+	}
+	if p.opts.Registry == nil {
+		p.opts.Registry = DefaultRegistry
+	}
+	if p.opts.MaxBodyBytes <= 0 {
+		p.opts.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if p.opts.PeerIdentities == nil {
+		switch a := p.opts.Auth.(type) {
+		case *HMACAuth:
+			p.opts.PeerIdentities = []string{a.signKey}
+		case *BearerAuth:
+			p.opts.PeerIdentities = []string{a.tokens[a.token]}
+		}
+	}
+	p.Transport = p.opts.Transport
+	if p.Transport == nil && p.opts.TLS != nil {
+		t := NewTransport()
+		t.DialTLSContext = p.opts.TLS.DialTLSContext
+		p.Transport = func(context.Context) http.RoundTripper { return t }
 	}
+	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
+	return p
+}
+
+// H2CHandler returns p wrapped to also accept HTTP/2 over cleartext (h2c).
+func (p *HTTPPool) H2CHandler() http.Handler {
+	return h2c.NewHandler(p, &http2.Server{})
 }
 
 // ServeHTTP handle all http requests
+//
+//	GET    /<basepath>/<groupname>/<key>[?expire=ttl]  get, loading on a miss
+//	HEAD   /<basepath>/<groupname>/<key>               whether key is cached here
+//	PUT    /<basepath>/<groupname>/<key>[?expire=ttl]  set the body as value
+//	DELETE /<basepath>/<groupname>/<key>               invalidate key
+//
+// ttl is in seconds ("30") or a Go duration ("1m30s"), no ttl never expires.
+// PUT and DELETE are forwarded to the key's owner, which then drops the
+// copies other peers keep in their hot cache if peers can authenticate,
+// see HTTPPoolOptions.PeerIdentities.
 func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !strings.HasPrefix(r.URL.Path, p.basePath) {
-		panic("HTTPPool serving unexpected path: " + r.URL.Path)
+	if !strings.HasPrefix(r.URL.Path, p.opts.BasePath) {
+		http.NotFound(w, r)
+		return
 	}
 	p.Log("%s %s", r.Method, r.URL.Path)
+	if r = p.authenticate(w, r); r == nil {
+		return
+	}
 	// /<basepath>/<groupname>/<key> required
-	parts := strings.SplitN(r.URL.Path[len(p.basePath):], "/", 2)
-	if len(parts) != 2 {
+	parts := strings.SplitN(r.URL.Path[len(p.opts.BasePath):], "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	expire := r.URL.Query().Get("expire")
-	var expireTime time.Time
-	if expire == "" {
-		expireTime = time.Time(time.Unix(0, 0))
-	} else {
-		ns, err := strconv.Atoi(expire)
-		if err != nil {
-			http.Error(w, "expire wrong type "+expire, http.StatusNotFound)
+	groupName := parts[0]
+	key := parts[1]
+
+	// 先检查权限, 避免向无权限的调用方暴露group是否存在
+	if p.opts.ACL != nil {
+		identity := requestIdentity(r.Context(), r.TLS)
+		if op := methodOp(r.Method); !p.opts.ACL.Allow(identity, groupName, op) {
+			http.Error(w, fmt.Sprintf("%v may not %v %v", identity, op, groupName), http.StatusForbidden)
 			return
 		}
-		expireTime = time.Now()
-		expireTime.Add(time.Second * time.Duration(ns))
 	}
-	groupName := parts[0]
-	key := parts[1]
 
-	group := GetGroup(groupName)
+	group := p.opts.Registry.GetGroup(groupName)
 	if group == nil {
 		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
 		return
 	}
 
-	view, err := group.Get(key, expireTime)
+	// 只有peer能标记转发过的写请求, 否则客户端可以绕过owner写入任意节点
+	if r.Header.Get(forwardedHeader) != "" && !p.fromPeer(r) {
+		r.Header.Del(forwardedHeader)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p.serveGet(w, r, group, key)
+	case http.MethodHead:
+		p.serveHead(w, r, group, key)
+	case http.MethodPut:
+		if !p.forward(w, r, group, key) {
+			p.servePut(w, r, group, key)
+		}
+	case http.MethodDelete:
+		group.Remove(key)
+		if !p.forward(w, r, group, key) {
+			p.invalidate(r, group, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodPost:
+		if r.URL.Query().Has("lease") {
+			p.serveLease(w, r, group, key)
+			return
+		}
+		fallthrough
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authenticate caps the body of r at MaxBodyBytes, verifies r with the
+// pool's Auth and returns it with the caller's identity, or answers 401 and
+// returns nil. The body is read to check its digest and replaced for the
+// handlers, requests without credentials are rejected before it is read.
+func (p *HTTPPool) authenticate(w http.ResponseWriter, r *http.Request) *http.Request {
+	r.Body = http.MaxBytesReader(w, r.Body, p.opts.MaxBodyBytes)
+	if p.opts.Auth == nil {
+		return r
+	}
+	challenge := ""
+	switch p.opts.Auth.(type) {
+	case *HMACAuth:
+		challenge = hmacScheme
+	case *BearerAuth:
+		challenge = "Bearer"
+	}
+	unauthorized := func(err error) *http.Request {
+		if challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" || challenge != "" && !strings.HasPrefix(authorization, challenge+" ") {
+		return unauthorized(ErrUnauthenticated)
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	identity, err := p.opts.Auth.Verify(r.Method, httpResource(r.URL), body, authorization)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return unauthorized(err)
+	}
+	return r.WithContext(withIdentity(r.Context(), identity))
+}
+
+// readBody reads the body of r, it answers 413 if the body is over
+// MaxBodyBytes or 400 if it can not be read
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return nil, false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// methodOp maps an HTTP method to the ACL operation it performs,
+// POST is only used for leases
+func methodOp(method string) Op {
+	switch method {
+	case http.MethodPut:
+		return OpSet
+	case http.MethodDelete:
+		return OpDelete
+	case http.MethodPost:
+		return OpLease
+	}
+	return OpGet
+}
+
+func (p *HTTPPool) serveGet(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	expire, err := parseExpire(r.URL.Query().Get("expire"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	contentType := negotiate(r.Header.Get("Accept"))
+	if contentType == "" {
+		http.Error(w, "acceptable types: "+strings.Join([]string{contentTypeProtobuf, contentTypeRaw, contentTypeJSON}, ", "), http.StatusNotAcceptable)
+		return
+	}
+
+	// 条件请求命中本地cache时直接返回304, 不需要加载
+	if it, itExpire, ok := group.peek(key); ok && notModified(r, it) {
+		setCacheHeaders(w, it, itExpire)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	group.Stats.ServerRequests.Add(1)
+	view, err := group.get(r.Context(), key, expire)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	// 值来自peer时本地没有缓存, 只能给出ETag
+	it, itExpire, ok := group.peek(key)
+	if fresh := newItem(view, time.Time{}); !ok || it.version != fresh.version {
+		it, itExpire = fresh, time.Time{}
+	}
+	setCacheHeaders(w, it, itExpire)
+	if notModified(r, it) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	// Write the value to the response body as a proto message.
-	body, err := proto.Marshal(&pb.Response{Value: view.ByteSlice()}) // 传输数据使用protobuf进行压缩
+	b, c, err := view.wire(r.Header.Get(acceptCompressedHeader) != "" && contentType != contentTypeJSON)
+	if err != nil {
+		http.Error(w, group.dropCorrupt(key, err).Error(), http.StatusBadGateway)
+		return
+	}
+	var body []byte
+	switch contentType {
+	case contentTypeRaw:
+		// 直接从cache中的字节写出, 不做拷贝
+		w.Header().Set("Content-Type", contentType)
+		if c != CompressNone {
+			w.Header().Set(compressionHeader, c.String())
+		}
+		w.Header().Set(sizeHeader, strconv.Itoa(len(b)))
+		w.Header().Set(checksumHeader, strconv.FormatUint(uint64(checksum(b)), 10))
+		if len(b) <= transferChunkSize {
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			w.Write(b)
+			return
+		}
+		// 大value不带Content-Length, 以chunked编码分块写出
+		flusher, _ := w.(http.Flusher)
+		for off := 0; off < len(b); off += transferChunkSize {
+			if _, err := w.Write(b[off:min(len(b), off+transferChunkSize)]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return
+	case contentTypeJSON:
+		// 本地有缓存则来源是自己, 否则是从owner节点取得的
+		source := p.self
+		if !ok {
+			source = p.owner(key)
+		}
+		jv := jsonValue{
+			Key:     key,
+			Value:   string(b),
+			TTL:     -1,
+			Version: strings.Trim(etag(it), `"`),
+			Source:  source,
+		}
+		if !utf8.Valid(b) {
+			jv.Value, jv.Encoding = base64.StdEncoding.EncodeToString(b), "base64"
+		}
+		if !itExpire.IsZero() {
+			jv.TTL = ttlSeconds(itExpire)
+		}
+		body, err = json.Marshal(jv)
+	default:
+		// Write the value to the response body as a proto message.
+		// view is immutable, so it is marshaled in place
+		body, err = proto.Marshal(&pb.Response{Value: b, Compression: uint32(c)}) // 传输数据使用protobuf进行压缩
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Type", contentType)
 	w.Write(body)
 }
 
+// jsonValue is the application/json representation of a value
+type jsonValue struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`              // the value as text if it is valid UTF-8
+	Encoding string `json:"encoding,omitempty"` // "base64" if it is not
+	TTL      int    `json:"ttl"`                // seconds left, -1 if it never expires
+	Version  string `json:"version"`
+	Source   string `json:"source"` // peer the value was served from
+}
+
+func ttlSeconds(expire time.Time) int {
+	if expire.IsZero() {
+		return 0
+	}
+	return max(int(time.Until(expire)/time.Second), 0)
+}
+
+// negotiate picks the media type to answer with from the Accept header.
+// It returns "" if none of the supported types is acceptable.
+func negotiate(accept string) string {
+	if accept == "" {
+		return contentTypeProtobuf
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch mediaType = strings.ToLower(strings.TrimSpace(mediaType)); mediaType {
+		case "*/*", "application/*":
+			mediaType = contentTypeProtobuf
+		case contentTypeProtobuf, contentTypeRaw, contentTypeJSON:
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
+
+// owner returns the peer owning key on the ring
+func (p *HTTPPool) owner(key string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peers.Get(key)
+}
+
+// serveHead reports whether key is cached on this node, without loading it
+func (p *HTTPPool) serveHead(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	it, expire, ok := group.peek(key)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	setCacheHeaders(w, it, expire)
+	if notModified(r, it) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(it.Len()))
+	if !expire.IsZero() {
+		w.Header().Set("Expires", expire.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func etag(it item) string {
+	return `"` + strconv.FormatUint(it.version, 16) + `"`
+}
+
+// setCacheHeaders sets ETag, Last-Modified and a Cache-Control max-age
+// matching the remaining TTL
+func setCacheHeaders(w http.ResponseWriter, it item, expire time.Time) {
+	h := w.Header()
+	h.Set("ETag", etag(it))
+	if !it.modified.IsZero() {
+		h.Set("Last-Modified", it.modified.UTC().Format(http.TimeFormat))
+	}
+	if !expire.IsZero() {
+		maxAge := int(time.Until(expire) / time.Second)
+		h.Set("Cache-Control", "max-age="+strconv.Itoa(max(maxAge, 0)))
+	}
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when there is
+// no If-None-Match, as RFC 9110 requires
+func notModified(r *http.Request, it item) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		tag := etag(it)
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == tag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !it.modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !it.modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+func (p *HTTPPool) servePut(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	expire, err := parseExpire(r.URL.Query().Get("expire"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	group.Set(key, value, expire)
+	p.invalidate(r, group, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forwardedHeader marks a write sent by a peer: "owner" is a write the
+// peer forwarded to the key's owner, "invalidate" asks to drop a stale copy.
+// Neither is forwarded again.
+const forwardedHeader = "X-Dcache-Forwarded"
+
+// forward sends a write to the key's owner and relays its answer, it
+// reports false if this node should apply the write itself
+func (p *HTTPPool) forward(w http.ResponseWriter, r *http.Request, group *Group, key string) bool {
+	if r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	peer, ok := p.PickPeer(key)
+	if !ok {
+		return false
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return true
+	}
+	err := peer.(*httpGetter).write(r.Context(), r.Method, group.name, key, r.URL.RawQuery, body, "owner")
+	var se *StatusError
+	switch {
+	case errors.As(err, &se):
+		http.Error(w, se.Status, se.Code)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return true
+}
+
+// fromPeer reports whether r was authenticated as a node of the cluster
+func (p *HTTPPool) fromPeer(r *http.Request) bool {
+	identity := requestIdentity(r.Context(), r.TLS)
+	if identity != Anonymous && slices.Contains(p.opts.PeerIdentities, identity) {
+		return true
+	}
+	return p.opts.TLS != nil && p.opts.TLS.isMember(r.TLS)
+}
+
+// peersAuthenticate reports whether the requests of this node can be told
+// apart from a client's by fromPeer
+func (p *HTTPPool) peersAuthenticate() bool {
+	return len(p.opts.PeerIdentities) > 0 || p.opts.TLS != nil && p.opts.TLS.opts.TrustDomain != ""
+}
+
+// invalidate asks the other peers to drop their copy of key after the
+// owner applied a write, failures are only logged. Without peer
+// authentication the peers would forward the request back to the owner,
+// so nothing is sent and their copies expire with their TTL.
+func (p *HTTPPool) invalidate(r *http.Request, group *Group, key string) {
+	if r.Header.Get(forwardedHeader) == "invalidate" || !p.peersAuthenticate() {
+		return
+	}
+	p.mu.Lock()
+	peers := make([]*httpGetter, 0, len(p.httpGetters))
+	for addr, h := range p.httpGetters {
+		if addr != p.self {
+			peers = append(peers, h)
+		}
+	}
+	p.mu.Unlock()
+	for _, h := range peers {
+		go func() {
+			// 写请求返回后继续执行, 不随请求的context取消
+			ctx := context.WithoutCancel(r.Context())
+			if err := h.write(ctx, http.MethodDelete, group.name, key, "", nil, "invalidate"); err != nil {
+				p.Log("invalidate %s/%s on %s: %v", group.name, key, h.baseURL, err)
+			}
+		}()
+	}
+}
+
+// parseExpire turns a ttl in seconds or a Go duration into an expire time,
+// an empty ttl means never expire
+func parseExpire(ttl string) (time.Time, error) {
+	if ttl == "" {
+		return time.Time{}, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		secs, err := strconv.Atoi(ttl)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad expire %q: want seconds or a duration like 1m30s", ttl)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 {
+		return time.Time{}, fmt.Errorf("bad expire %q: must be positive", ttl)
+	}
+	return time.Now().Add(d), nil
+}
+
+// httpResource is what a request signature covers: the path and the query
+func httpResource(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// httpError writes err with the status code matching its kind
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		// 和"no such group"等其它404区分开, 只有它会被peer当作ErrNotFound
+		w.Header().Set(errorHeader, errorNotFound)
+		code = http.StatusNotFound
+	case errors.Is(err, ErrOverloaded):
+		w.Header().Set(errorHeader, errorOverloaded)
+		w.Header().Set("Retry-After", "1")
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// serveLease handles POST /<basepath>/<groupname>/<key>?lease=acquire|release
+// with a pb.LeaseRequest body
+func (p *HTTPPool) serveLease(w http.ResponseWriter, r *http.Request, group *Group, key string) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	req := &pb.LeaseRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := &pb.LeaseResponse{}
+	switch r.URL.Query().Get("lease") {
+	case "acquire":
+		group.leases.acquire(key, res)
+	case "release":
+		group.leases.release(key, req.Token, req.Value)
+	default:
+		http.Error(w, "bad lease op", http.StatusBadRequest)
+		return
+	}
+
+	body, err := proto.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeProtobuf)
+	w.Write(body)
+}
+
+// errorHeader tells a peer why a request failed, a 404 or 503 without it
+// means something else than a missing key or shed load, e.g. an unknown
+// group or a proxy without backends
+const (
+	errorHeader     = "X-Dcache-Error"
+	errorNotFound   = "not-found"
+	errorOverloaded = "overloaded"
+)
+
+// StatusError is returned by httpGetter when a peer answers with a non-200 status.
+type StatusError struct {
+	Code   int
+	Status string
+	Reason string // the X-Dcache-Error header, if any
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned: %v", e.Status)
+}
+
+// Unwrap lets errors.Is match ErrNotFound and ErrOverloaded
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.Code == http.StatusNotFound && e.Reason == errorNotFound:
+		return ErrNotFound
+	case e.Code == http.StatusServiceUnavailable && e.Reason == errorOverloaded:
+		return ErrOverloaded
+	}
+	return nil
+}
+
 type httpGetter struct {
+	pool    *HTTPPool // transport, timeout and header settings
 	baseURL string
 }
 
 var _ PeerGetter = (*httpGetter)(nil) // 类型转换, 确保*httpGetter实现了PeerGetter接口, 保证健壮性
 
-func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
+func (h *httpGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	u := fmt.Sprintf(
+		"%v%v/%v",
+		h.baseURL,
+		url.QueryEscape(in.GetGroup()),
+		url.QueryEscape(in.GetKey()),
+	)
+	header := http.Header{"Accept": {contentTypeRaw}}
+	if in.AcceptCompressed {
+		header.Set(acceptCompressedHeader, "1")
+	}
+	return h.roundTrip(ctx, http.MethodGet, u, nil, header, func(res *http.Response) error {
+		if v := res.Header.Get(compressionHeader); v != "" {
+			c, ok := parseCompression(v)
+			if !ok {
+				return fmt.Errorf("unknown compression %q", v)
+			}
+			out.Compression = uint32(c)
+		}
+		value, err := readValue(res)
+		out.Value = value
+		return err
+	})
+}
+
+// readValue reads a raw value as it arrives and checks it against the size
+// and checksum headers, if the peer sent them
+func readValue(res *http.Response) ([]byte, error) {
+	size, _ := strconv.ParseUint(res.Header.Get(sizeHeader), 10, 64)
+	if size == 0 && res.ContentLength > 0 {
+		size = uint64(res.ContentLength)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, min(size, maxPrealloc)))
+	crc := crc32.New(castagnoli)
+	if _, err := io.Copy(io.MultiWriter(buf, crc), res.Body); err != nil {
+		return nil, fmt.Errorf("reading response body: %v", err)
+	}
+	if v := res.Header.Get(sizeHeader); v != "" && v != strconv.Itoa(buf.Len()) {
+		return nil, fmt.Errorf("%w: got %d bytes, want %s", ErrChecksum, buf.Len(), v)
+	}
+	if v := res.Header.Get(checksumHeader); v != "" && v != strconv.FormatUint(uint64(crc.Sum32()), 10) {
+		return nil, ErrChecksum
+	}
+	return buf.Bytes(), nil
+}
+
+var _ LeaseGetter = (*httpGetter)(nil)
+
+func (h *httpGetter) Lease(ctx context.Context, in *pb.LeaseRequest, out *pb.LeaseResponse) error {
+	return h.lease(ctx, "acquire", in, out)
+}
+
+func (h *httpGetter) Release(ctx context.Context, in *pb.LeaseRequest, out *pb.LeaseResponse) error {
+	return h.lease(ctx, "release", in, out)
+}
+
+// write sends a PUT or DELETE marked with forwarded to the peer
+func (h *httpGetter) write(ctx context.Context, method, group, key, rawQuery string, body []byte, forwarded string) error {
 	u := fmt.Sprintf(
 		"%v%v/%v",
 		h.baseURL,
+		url.QueryEscape(group),
+		url.QueryEscape(key),
+	)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	header := http.Header{forwardedHeader: {forwarded}}
+	if method == http.MethodPut {
+		header.Set("Content-Type", contentTypeRaw)
+	}
+	return h.roundTrip(ctx, method, u, body, header, func(*http.Response) error {
+		return nil
+	})
+}
+
+func (h *httpGetter) lease(ctx context.Context, op string, in *pb.LeaseRequest, out *pb.LeaseResponse) error {
+	u := fmt.Sprintf(
+		"%v%v/%v?lease=%v",
+		h.baseURL,
 		url.QueryEscape(in.GetGroup()),
 		url.QueryEscape(in.GetKey()),
+		op,
 	)
-	res, err := http.Get(u)
+	body, err := proto.Marshal(in)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
+	return h.roundTrip(ctx, http.MethodPost, u, body, http.Header{"Accept": {contentTypeProtobuf}}, func(res *http.Response) error {
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return fmt.Errorf("reading response body: %v", err)
+		}
+		if err = proto.Unmarshal(b, out); err != nil { // 对protobuf压缩的数据解码
+			return fmt.Errorf("decoding response body: %v", err)
+		}
+		return nil
+	})
+}
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned: %v", res.Status)
+// roundTrip sends a request with header to the peer, and hands a 200
+// answer to decode
+func (h *httpGetter) roundTrip(ctx context.Context, method, u string, body []byte, header http.Header, decode func(*http.Response) error) error {
+	if h.pool.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.pool.Timeout)
+		defer cancel()
 	}
 
-	bytes, err := io.ReadAll(res.Body)
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
 	if err != nil {
-		return fmt.Errorf("reading response body: %v", err)
+		return err
+	}
+	if h.pool.Header != nil {
+		for k, vs := range h.pool.Header(ctx) {
+			req.Header[k] = vs
+		}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentTypeProtobuf)
+	}
+	if h.pool.opts.Auth != nil {
+		authorization, err := h.pool.opts.Auth.Sign(method, httpResource(req.URL), body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", authorization)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
 	}
 
-	if err = proto.Unmarshal(bytes, out); err != nil { // 对protobuf压缩的数据解码
-		return fmt.Errorf("decoding response body: %v", err)
+	tr := defaultTransport
+	if h.pool.Transport != nil {
+		tr = h.pool.Transport(ctx)
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
 	}
+	defer res.Body.Close()
 
-	return nil
+	if res.StatusCode != http.StatusOK {
+		return &StatusError{Code: res.StatusCode, Status: res.Status, Reason: res.Header.Get(errorHeader)}
+	}
+	return decode(res)
 }
 
 // Set updates the pool's list of peers.
 func (p *HTTPPool) Set(peers ...string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.peers = consistenthash.New(defaultReplicas, nil)
+	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
 	p.peers.Add(peers...)
+	if p.opts.TLS != nil {
+		p.opts.TLS.setMembers(peers)
+	}
 	p.httpGetters = make(map[string]*httpGetter, len(peers))
 	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{baseURL: peer + p.basePath}
+		p.httpGetters[peer] = &httpGetter{pool: p, baseURL: peer + p.opts.BasePath}
 	}
 }
 
@@ -150,6 +937,19 @@ func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
 	return nil, false
 }
 
+var _ FallbackPicker = (*HTTPPool)(nil)
+
+// PickFallback picks the node after the key's owner on the ring, which
+// arbitrates leases for the key while the owner is unreachable
+func (p *HTTPPool) PickFallback(key string) (PeerGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if nodes := p.peers.GetN(key, 2); len(nodes) == 2 && nodes[1] != p.self {
+		return p.httpGetters[nodes[1]], true
+	}
+	return nil, false
+}
+
 // Log info with server name
 func (p *HTTPPool) Log(format string, v ...interface{}) {
 	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
@@ -0,0 +1,169 @@
+package dcache
+
+import (
+	"context"
+	"dcache/pb"
+	"sync"
+	"time"
+)
+
+/*
+owner节点不可达时, 所有节点会同时回退到getLocally, 瞬间打满数据库.
+参考Facebook memcache的lease机制: 由key在哈希环上的下一个节点(fallback节点)充当仲裁者,
+只有拿到lease的节点去加载数据, 其它节点短暂等待后从仲裁者处取得加载结果, 或者直接拿到旧值.
+*/
+
+const (
+	leaseTTL           = 2 * time.Second       // holder must release before this, otherwise the lease is handed out again
+	leaseFreshTTL      = time.Second           // how long a released value is served to waiters as fresh
+	leaseStaleTTL      = 10 * time.Second      // how long a released value may be served as stale
+	leaseRetryInterval = 20 * time.Millisecond // waiters poll the arbiter at this interval
+	leasePurgeSize     = 1024                  // purge expired leases once the table grows beyond this
+
+	// maxLeaseValue is the largest value handed to waiters through the
+	// arbiter. Lease RPCs are unary and bounded by gRPC's message size,
+	// waiters for larger values take the lease in turn and load it themselves.
+	maxLeaseValue = transferChunkSize
+)
+
+type lease struct {
+	token uint64    // 0 if nobody holds the lease
+	until time.Time // lease expiry
+	value []byte    // last value released under a lease
+	fresh time.Time // value is fresh until
+	stale time.Time // value may be served as stale until
+}
+
+// leaseTable arbitrates which node loads a key while its owner is down.
+type leaseTable struct {
+	mu        sync.Mutex
+	leases    map[string]*lease
+	nextToken uint64
+	lastPurge time.Time
+}
+
+func (t *leaseTable) acquire(key string, out *pb.LeaseResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.leases == nil {
+		t.leases = make(map[string]*lease)
+	}
+	now := time.Now()
+	t.purge(now)
+
+	l, ok := t.leases[key]
+	if !ok {
+		l = &lease{}
+		t.leases[key] = l
+	}
+	// 已有节点加载完成, 直接返回结果
+	if l.value != nil && now.Before(l.fresh) {
+		out.Value = l.value
+		return
+	}
+	// 其它节点正持有lease, 有旧值则返回旧值, 否则让调用方等待
+	if l.token != 0 && now.Before(l.until) {
+		if l.value != nil && now.Before(l.stale) {
+			out.Value, out.Stale = l.value, true
+		}
+		return
+	}
+
+	t.nextToken++
+	l.token = t.nextToken
+	l.until = now.Add(leaseTTL)
+	out.Granted, out.Token = true, l.token
+}
+
+// release gives up the lease, value is nil if the holder failed to load
+func (t *leaseTable) release(key string, token uint64, value []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.leases[key]
+	if !ok || l.token != token {
+		return // expired and handed out again
+	}
+	l.token = 0
+	if value != nil && len(value) <= maxLeaseValue {
+		now := time.Now()
+		l.value = value
+		l.fresh = now.Add(leaseFreshTTL)
+		l.stale = now.Add(leaseStaleTTL)
+	}
+}
+
+func (t *leaseTable) purge(now time.Time) {
+	if len(t.leases) < leasePurgeSize || now.Sub(t.lastPurge) < leaseStaleTTL {
+		return
+	}
+	t.lastPurge = now
+	for key, l := range t.leases {
+		if now.After(l.until) && now.After(l.stale) {
+			delete(t.leases, key)
+		}
+	}
+}
+
+// loadWithLease is the owner-fallback path: only the node holding the lease
+// from the arbiter calls getLocally, the others wait for its result.
+// arbiter is nil when this node is the arbiter itself.
+func (g *Group) loadWithLease(ctx context.Context, arbiter LeaseGetter, key string, expire time.Time) (ByteView, error) {
+	acquire := func(out *pb.LeaseResponse) error {
+		if arbiter == nil {
+			g.leases.acquire(key, out)
+			return nil
+		}
+		return arbiter.Lease(ctx, &pb.LeaseRequest{Group: g.name, Key: key}, out)
+	}
+	release := func(token uint64, value []byte) {
+		if arbiter == nil {
+			g.leases.release(key, token, value)
+			return
+		}
+		err := arbiter.Release(ctx, &pb.LeaseRequest{Group: g.name, Key: key, Token: token, Value: value}, &pb.LeaseResponse{})
+		if err != nil {
+			g.logf("[DCache] Failed to release lease %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(g.config.LeaseWait)
+	for {
+		res := &pb.LeaseResponse{}
+		if err := acquire(res); err != nil {
+			// 仲裁者也不可达, 退化为直接加载
+			g.logf("[DCache] Failed to acquire lease %v", err)
+			return g.getLocally(ctx, key, expire)
+		}
+		if res.Granted {
+			value, err := g.getLocally(ctx, key, expire)
+			if err != nil {
+				release(res.Token, nil)
+				return value, err
+			}
+			// lease的值不带压缩标记, 传原始字节
+			if value.Len() > maxLeaseValue {
+				release(res.Token, nil)
+			} else {
+				release(res.Token, value.data())
+			}
+			return value, nil
+		}
+		if len(res.Value) > 0 {
+			// 新值放入本地cache, 旧值只返回给调用方
+			value := ByteView{b: res.Value}
+			if !res.Stale {
+				value = g.populateCache(key, value, expire, 0)
+			}
+			return value, nil
+		}
+		if time.Now().After(deadline) {
+			return g.getLocally(ctx, key, expire)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ByteView{}, ctx.Err()
+		case <-time.After(leaseRetryInterval):
+		}
+	}
+}
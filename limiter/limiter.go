@@ -0,0 +1,160 @@
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+限制同时访问数据库等后端的请求数. 超出limit的请求进入有界队列等待,
+队列已满或等待超时则立即失败, 由调用方返回overloaded错误, 而不是把压力继续传给后端.
+AIMD变体参考Netflix concurrency-limits: 延迟正常时limit加性增长, 超时时乘性减小.
+*/
+
+// ErrLimitExceeded is returned when the queue is full or the queue timeout elapsed.
+var ErrLimitExceeded = errors.New("limiter: limit exceeded")
+
+// Limiter bounds the number of concurrent operations.
+type Limiter interface {
+	// Acquire waits for a free slot. release must be called exactly once
+	// when the operation is finished.
+	Acquire(ctx context.Context) (release func(), err error)
+}
+
+// Options configures the queue in front of the limit.
+type Options struct {
+	// QueueSize is how many callers may wait for a slot, 0 rejects at once
+	QueueSize int
+	// QueueTimeout bounds the wait in the queue, 0 waits as long as ctx allows
+	QueueTimeout time.Duration
+}
+
+// queue implements Limiter with a FIFO of waiters, onSample lets
+// adaptive limiters move the limit
+type queue struct {
+	Options
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	waiters  list.List // of chan struct{}, closed when a slot is handed over
+	onSample func(rtt time.Duration, inflight int)
+}
+
+// NewFixed returns a Limiter allowing limit concurrent operations.
+func NewFixed(limit int, opts Options) Limiter {
+	if limit <= 0 {
+		panic("limiter: limit must be > 0")
+	}
+	return &queue{Options: opts, limit: float64(limit)}
+}
+
+func (q *queue) Acquire(ctx context.Context) (func(), error) {
+	q.mu.Lock()
+	if q.inflight < int(q.limit) && q.waiters.Len() == 0 {
+		q.inflight++
+		q.mu.Unlock()
+		return q.releaser(), nil
+	}
+	if q.waiters.Len() >= q.QueueSize {
+		q.mu.Unlock()
+		return nil, ErrLimitExceeded
+	}
+	ch := make(chan struct{})
+	e := q.waiters.PushBack(ch)
+	q.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if q.QueueTimeout > 0 {
+		timer := time.NewTimer(q.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	err := ErrLimitExceeded
+	select {
+	case <-ch:
+		return q.releaser(), nil
+	case <-timeout:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-ch:
+		// 超时的同时拿到了slot, 归还给下一个等待者
+		q.inflight--
+		q.handOff()
+	default:
+		q.waiters.Remove(e)
+	}
+	return nil, err
+}
+
+func (q *queue) releaser() func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if q.onSample != nil {
+				q.onSample(time.Since(start), q.inflight)
+			}
+			q.inflight--
+			q.handOff()
+		})
+	}
+}
+
+// handOff gives free slots to waiters in FIFO order, q.mu must be held
+func (q *queue) handOff() {
+	for q.inflight < int(q.limit) && q.waiters.Len() > 0 {
+		ch := q.waiters.Remove(q.waiters.Front()).(chan struct{})
+		q.inflight++
+		close(ch)
+	}
+}
+
+// AIMDOptions configures an additive-increase/multiplicative-decrease limit.
+type AIMDOptions struct {
+	Options
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// Timeout is the latency above which an operation counts as overloaded
+	Timeout time.Duration
+	// BackoffRatio multiplies the limit on overload, e.g. 0.9
+	BackoffRatio float64
+}
+
+// NewAIMD returns a Limiter whose limit grows by one while operations are
+// fast and the limit is in use, and shrinks by BackoffRatio when one is slow.
+func NewAIMD(opts AIMDOptions) Limiter {
+	if opts.MinLimit <= 0 || opts.MaxLimit < opts.MinLimit {
+		panic("limiter: need 0 < MinLimit <= MaxLimit")
+	}
+	if opts.BackoffRatio <= 0 || opts.BackoffRatio >= 1 {
+		panic("limiter: BackoffRatio must be in (0, 1)")
+	}
+	if opts.Timeout <= 0 {
+		panic("limiter: Timeout must be > 0")
+	}
+	initial := min(max(opts.InitialLimit, opts.MinLimit), opts.MaxLimit)
+	q := &queue{Options: opts.Options, limit: float64(initial)}
+	q.onSample = func(rtt time.Duration, inflight int) {
+		switch {
+		case rtt > opts.Timeout:
+			q.limit = max(q.limit*opts.BackoffRatio, float64(opts.MinLimit))
+		case float64(inflight)*2 >= q.limit:
+			// 只有limit被充分使用时才增长, 避免空闲时limit无限变大
+			q.limit = min(q.limit+1, float64(opts.MaxLimit))
+		}
+	}
+	return q
+}
@@ -2,30 +2,78 @@ package lru
 
 import (
 	"container/list"
+	"math"
+	"math/rand"
 	"time"
+	"unsafe"
 )
 
+// EntryOverhead estimates the bytes each entry of a Cache[K, V] costs
+// besides the sizes its Sizer reports: the entry, its list.Element and its
+// slot in the map, which is a key and a pointer plus a control byte at a 7/8
+// load factor. The allocator's size classes round entry and list.Element up
+// a little more.
+func EntryOverhead[K comparable, V any]() int64 {
+	var key K
+	return int64(unsafe.Sizeof(entry[K, V]{})) +
+		int64(unsafe.Sizeof(list.Element{})) +
+		int64((unsafe.Sizeof(key)+unsafe.Sizeof(&list.Element{})+1)*8/7)
+}
+
 // Cache is a LRU cache. It is not safe for concurrent access.
 // map + 双向queue, 规定队列Front为最近访问的元素, Back为最近最久未被访问元素
-type Cache struct {
+type Cache[K comparable, V any] struct {
 	maxBytes int64
 	nbytes   int64
 	ll       *list.List
-	cache    map[string]*list.Element
+	cache    map[K]*list.Element
 	// optional and executed when an entry is purged.
-	OnEvicted func(key string, value Value) // 删除时触发的callback, 可以为nil
+	OnEvicted func(key K, value V) // 删除时触发的callback, 可以为nil
+
+	// Sizer returns how many bytes key and value take, it defaults to
+	// DefaultSizer and must not be changed after the first Add.
+	Sizer func(key K, value V) int64
 
 	// 增加TTL
 	Now NowFunc
+
+	// MaxEntries is the maximum number of cache entries before
+	// an item is evicted. Zero means no limit.
+	MaxEntries int
+	// FIFO evicts entries in insertion order instead of least recently used:
+	// Get and updates of an existing key do not move it to the front.
+	FIFO bool
+
+	// Beta enables XFetch probabilistic early expiration when > 0.
+	// 临近过期时, Get会以一定概率提前返回miss, 概率随剩余时间减少和加载耗时增加而增大,
+	// 从而让同一批写入的key分散地重新加载, 避免同时过期造成的缓存雪崩. 1.0为论文推荐值
+	Beta float64
+	// Rand returns a float in [0.0, 1.0), defaults to math/rand.Float64
+	Rand func() float64
+
+	// EntryOverhead is charged for every entry on top of its Sizer size,
+	// so that maxBytes bounds the real memory used. It defaults to
+	// EntryOverhead[K, V]() and must not be changed after the first Add.
+	EntryOverhead int64
+}
+
+// Stats describes the memory a Cache uses.
+type Stats struct {
+	Entries  int
+	Data     int64 // bytes of keys and values
+	Overhead int64 // estimated bytes of the cache's own structures
+	Bytes    int64 // Data + Overhead, what maxBytes is checked against
 }
 
 type NowFunc func() time.Time
 
-type entry struct {
-	key   string
-	value Value
+type entry[K comparable, V any] struct {
+	key   K
+	value V
 	// TTL
 	expire time.Time
+	// delta is how long it took to load the value, used by XFetch
+	delta time.Duration
 }
 
 // Value use Len to count how many bytes it takes
@@ -33,70 +81,203 @@ type Value interface {
 	Len() int
 }
 
-// New is the Constructor of Cache
-func New(maxBytes int64, onEvicted func(string, Value)) *Cache {
-	return &Cache{
+// DefaultSizer counts the length of string keys and of values that
+// implement Value, anything else counts as 0 bytes.
+func DefaultSizer[K comparable, V any](key K, value V) int64 {
+	var n int64
+	if s, ok := any(key).(string); ok {
+		n += int64(len(s))
+	}
+	if v, ok := any(value).(Value); ok {
+		n += int64(v.Len())
+	}
+	return n
+}
+
+// New is the Constructor of Cache, maxBytes = 0 means no byte limit
+func New[K comparable, V any](maxBytes int64, onEvicted func(K, V)) *Cache[K, V] {
+	return &Cache[K, V]{
 		maxBytes:  maxBytes,
 		ll:        list.New(),
-		cache:     make(map[string]*list.Element),
+		cache:     make(map[K]*list.Element),
 		OnEvicted: onEvicted,
+		Sizer:     DefaultSizer[K, V],
 		Now:       time.Now,
+		Rand:      rand.Float64,
+
+		EntryOverhead: EntryOverhead[K, V](),
 	}
 }
 
 // Get look ups a key's value
-func (c *Cache) Get(key string) (Value, bool) {
+func (c *Cache[K, V]) Get(key K) (value V, ok bool) {
 	if ele, ok := c.cache[key]; ok {
-		kv := ele.Value.(*entry) // ele.Value是list.Element.Value type -> any type, 转换成*entry type
-		if !kv.expire.IsZero() && kv.expire.Before(c.Now()) {
+		kv := ele.Value.(*entry[K, V]) // ele.Value是list.Element.Value type -> any type, 转换成*entry type
+		now := c.Now()
+		if !kv.expire.IsZero() && kv.expire.Before(now) {
 			c.RemoveElement(ele)
-			return nil, false
+			return value, false
+		}
+		// 提前过期只返回miss, 不删除元素, 其它读者仍可命中直到有人重新加载
+		if c.expireEarly(kv, now) {
+			return value, false
+		}
+		if !c.FIFO {
+			c.ll.MoveToFront(ele) // 双向list, 队头和队尾是相对的, 这里规定Front是队尾
 		}
-		c.ll.MoveToFront(ele) // 双向list, 队头和队尾是相对的, 这里规定Front是队尾
 		return kv.value, true
 	}
-	return nil, false
+	return
+}
+
+// Len returns the number of items in the cache.
+func (c *Cache[K, V]) Len() int {
+	return c.ll.Len()
+}
+
+// Bytes returns the number of bytes charged for the cached entries,
+// including EntryOverhead.
+func (c *Cache[K, V]) Bytes() int64 {
+	return c.nbytes
+}
+
+// Stats returns the estimated memory used by the cache.
+func (c *Cache[K, V]) Stats() Stats {
+	overhead := int64(c.ll.Len()) * c.EntryOverhead
+	return Stats{
+		Entries:  c.ll.Len(),
+		Data:     c.nbytes - overhead,
+		Overhead: overhead,
+		Bytes:    c.nbytes,
+	}
+}
+
+// charge is the number of bytes accounted for kv
+func (c *Cache[K, V]) charge(kv *entry[K, V]) int64 {
+	return c.Sizer(kv.key, kv.value) + c.EntryOverhead
+}
+
+// Purge removes all stored items from the cache, calling OnEvicted
+// for each of them.
+func (c *Cache[K, V]) Purge() {
+	for c.ll.Len() > 0 {
+		c.RemoveOldest()
+	}
+}
+
+// Resize changes the byte limit, evicting entries as needed, and returns
+// how many were evicted. maxBytes = 0 means no byte limit.
+func (c *Cache[K, V]) Resize(maxBytes int64) int {
+	c.maxBytes = maxBytes
+	n := c.ll.Len()
+	c.evict()
+	return n - c.ll.Len()
+}
+
+// Peek returns a key's value and expire time without updating
+// its recency, an expired entry is reported as missing.
+func (c *Cache[K, V]) Peek(key K) (value V, expire time.Time, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		kv := ele.Value.(*entry[K, V])
+		if !kv.expire.IsZero() && kv.expire.Before(c.Now()) {
+			return value, time.Time{}, false
+		}
+		return kv.value, kv.expire, true
+	}
+	return
+}
+
+// Contains reports whether key is cached and not expired,
+// without updating its recency.
+func (c *Cache[K, V]) Contains(key K) bool {
+	_, _, ok := c.Peek(key)
+	return ok
+}
+
+// Keys returns the cached keys from the most to the least recently used,
+// including expired entries not removed yet.
+func (c *Cache[K, V]) Keys() []K {
+	keys := make([]K, 0, c.ll.Len())
+	for ele := c.ll.Front(); ele != nil; ele = ele.Next() {
+		keys = append(keys, ele.Value.(*entry[K, V]).key)
+	}
+	return keys
+}
+
+// Remove removes the provided key from the cache, it reports whether
+// the key was present.
+func (c *Cache[K, V]) Remove(key K) bool {
+	if ele, ok := c.cache[key]; ok {
+		c.RemoveElement(ele)
+		return true
+	}
+	return false
+}
+
+// expireEarly implements the XFetch check:
+// now - delta * beta * ln(rand()) >= expire
+// see "Optimal Probabilistic Cache Stampede Prevention" (Vattani et al.)
+func (c *Cache[K, V]) expireEarly(kv *entry[K, V], now time.Time) bool {
+	if c.Beta <= 0 || kv.expire.IsZero() || kv.delta <= 0 {
+		return false
+	}
+	r := c.Rand()
+	if r <= 0 {
+		return true // ln(0) = -inf
+	}
+	gap := time.Duration(-float64(kv.delta) * c.Beta * math.Log(r))
+	return !now.Add(gap).Before(kv.expire)
 }
 
 // RemoveOldest removes the oldest item
-func (c *Cache) RemoveOldest() {
+func (c *Cache[K, V]) RemoveOldest() {
 	ele := c.ll.Back() // Back是队头, 也就是要淘汰的元素
 	if ele != nil {
-		c.ll.Remove(ele)
-		kv := ele.Value.(*entry)
-		delete(c.cache, kv.key)
-		c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.value)
-		}
+		c.RemoveElement(ele)
 	}
 }
 
 // Add adds a value to the cache.
-func (c *Cache) Add(key string, value Value, expire time.Time) {
+func (c *Cache[K, V]) Add(key K, value V, expire time.Time) {
+	c.AddWithDelta(key, value, expire, 0)
+}
+
+// AddWithDelta adds a value to the cache and records how long it took
+// to load, which drives the XFetch early expiration.
+func (c *Cache[K, V]) AddWithDelta(key K, value V, expire time.Time, delta time.Duration) {
 	if ele, ok := c.cache[key]; ok { // 如果key已存在, 修改元素
-		c.ll.MoveToFront(ele)
-		kv := ele.Value.(*entry)
-		c.nbytes += int64(value.Len()) - int64(kv.value.Len())
+		if !c.FIFO {
+			c.ll.MoveToFront(ele)
+		}
+		kv := ele.Value.(*entry[K, V])
+		c.nbytes += c.Sizer(key, value) - c.Sizer(key, kv.value)
 		kv.value = value
 		kv.expire = expire
+		kv.delta = delta
 
 	} else { // key不存在, 插入元素
-		ele := c.ll.PushFront(&entry{key, value, expire})
-		c.cache[key] = ele
-		c.nbytes += int64(len(key)) + int64(value.Len())
+		kv := &entry[K, V]{key, value, expire, delta}
+		c.cache[key] = c.ll.PushFront(kv)
+		c.nbytes += c.charge(kv)
 	}
-	// 如果插入后超出maxBytes了, 执行替换策略
+	c.evict()
+}
+
+// evict applies the replacement policy until the limits are met
+func (c *Cache[K, V]) evict() {
 	for c.maxBytes != 0 && c.maxBytes < c.nbytes {
 		c.RemoveOldest()
 	}
+	for c.MaxEntries != 0 && c.MaxEntries < c.ll.Len() {
+		c.RemoveOldest()
+	}
 }
 
-func (c *Cache) RemoveElement(ele *list.Element) {
+func (c *Cache[K, V]) RemoveElement(ele *list.Element) {
 	c.ll.Remove(ele)
-	kv := ele.Value.(*entry)
+	kv := ele.Value.(*entry[K, V])
 	delete(c.cache, kv.key)
-	c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	c.nbytes -= c.charge(kv)
 	if c.OnEvicted != nil {
 		c.OnEvicted(kv.key, kv.value)
 	}
@@ -0,0 +1,175 @@
+package dcache
+
+import (
+	"math"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// A MemoryManager keeps the caches of several groups within one byte budget.
+// When the budget is exceeded it evicts from the groups whose cached bytes
+// are worth the least, i.e. with the lowest hit density (hits per byte since
+// the last check, divided by the group's weight).
+//
+// The budget is enforced by a background goroutine, so it may be exceeded
+// for up to MemoryOptions.Interval.
+type MemoryManager struct {
+	opts MemoryOptions
+
+	mu     sync.Mutex
+	groups map[*Group]*memoryGroup
+	lastGC uint64 // GC cycle the heap was last checked against HeapLimit
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// MemoryOptions are the configurations of a MemoryManager.
+type MemoryOptions struct {
+	// Limit is the total bytes of all groups' caches, 0 means no limit.
+	Limit int64
+
+	// HeapLimit shrinks the caches when the heap live after the last GC,
+	// as reported by runtime/metrics, exceeds it, by as much as it is
+	// exceeded. Evicted bytes only leave the heap at the next GC, so this
+	// is done once per GC cycle. 0 disables it.
+	HeapLimit int64
+
+	// Interval is how often the budget is checked.
+	// If blank, it defaults to 100ms.
+	Interval time.Duration
+}
+
+// A MemoryShare is how a group takes part in a MemoryManager's budget.
+type MemoryShare struct {
+	// Weight scales the value of the group's cached bytes, a group with
+	// weight 2 keeps about twice as many bytes as one with weight 1 for
+	// the same hit rate. If blank, it defaults to 1.
+	Weight float64
+	// Min is how many bytes the group keeps when evicting to meet the
+	// budget, up to the size of one entry less.
+	Min int64
+	// Max caps the group's bytes, 0 means no cap.
+	Max int64
+}
+
+type memoryGroup struct {
+	share    MemoryShare
+	lastHits int64 // main and hot cache hits at the previous check
+	hits     int64 // hits since the previous check
+}
+
+const (
+	defaultMemoryInterval = 100 * time.Millisecond
+	heapLiveMetric        = "/gc/heap/live:bytes"
+	gcCyclesMetric        = "/gc/cycles/total:gc-cycles"
+)
+
+// NewMemoryManager starts a MemoryManager, Close stops it.
+func NewMemoryManager(opts MemoryOptions) *MemoryManager {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultMemoryInterval
+	}
+	m := &MemoryManager{
+		opts:   opts,
+		groups: make(map[*Group]*memoryGroup),
+		stop:   make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// Close stops the background goroutine, groups keep their cached values.
+func (m *MemoryManager) Close() {
+	m.closeOnce.Do(func() { close(m.stop) })
+}
+
+func (m *MemoryManager) register(g *Group, share MemoryShare) {
+	m.mu.Lock()
+	m.groups[g] = &memoryGroup{share: share}
+	m.mu.Unlock()
+}
+
+func (m *MemoryManager) unregister(g *Group) {
+	m.mu.Lock()
+	delete(m.groups, g)
+	m.mu.Unlock()
+}
+
+func (m *MemoryManager) run() {
+	t := time.NewTicker(m.opts.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+			m.shrink()
+		}
+	}
+}
+
+// shrink evicts until every group is within its Max and the total is
+// within the budget
+func (m *MemoryManager) shrink() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for g, mg := range m.groups {
+		bytes := g.cacheBytes()
+		hits := g.mainCache.stats().Hits + g.hotCache.stats().Hits
+		mg.hits, mg.lastHits = hits-mg.lastHits, hits
+		for mg.share.Max > 0 && bytes > mg.share.Max && g.evictOldest() {
+			bytes = g.cacheBytes()
+		}
+		total += bytes
+	}
+
+	target := m.target(total)
+	for total > target {
+		// 每次从边际效用最低的group淘汰一个元素, 淘汰后它的密度上升, 自然在group间平衡
+		var victim *Group
+		var bytes int64
+		lowest := math.Inf(1)
+		for g, mg := range m.groups {
+			b := g.cacheBytes()
+			if b <= mg.share.Min || b == 0 {
+				continue
+			}
+			// +1 so that groups without hits are still ordered by size
+			if d := float64(mg.hits+1) / float64(b) / mg.share.Weight; d < lowest {
+				victim, bytes, lowest = g, b, d
+			}
+		}
+		if victim == nil || !victim.evictOldest() {
+			return
+		}
+		freed := bytes - victim.cacheBytes()
+		total -= freed
+	}
+}
+
+// target is the total bytes allowed given the limit and the measured heap
+func (m *MemoryManager) target(total int64) int64 {
+	target := int64(math.MaxInt64)
+	if m.opts.Limit > 0 {
+		target = m.opts.Limit
+	}
+	if m.opts.HeapLimit > 0 {
+		sample := []metrics.Sample{{Name: heapLiveMetric}, {Name: gcCyclesMetric}}
+		metrics.Read(sample)
+		if sample[0].Value.Kind() != metrics.KindUint64 || sample[1].Value.Kind() != metrics.KindUint64 {
+			return target
+		}
+		// 同一个GC周期内live heap不变, 上次淘汰的字节还没被回收, 不能重复淘汰
+		if cycles := sample[1].Value.Uint64(); cycles != m.lastGC {
+			m.lastGC = cycles
+			if heap := int64(sample[0].Value.Uint64()); heap > m.opts.HeapLimit {
+				target = min(target, total-(heap-m.opts.HeapLimit))
+			}
+		}
+	}
+	return target
+}
@@ -0,0 +1,406 @@
+package dcache
+
+import (
+	"dcache/limiter"
+	"fmt"
+	"log"
+	"time"
+)
+
+// EvictionPolicy decides which entry a full cache evicts.
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts the least recently used entry.
+	EvictLRU EvictionPolicy = iota
+	// EvictFIFO evicts the oldest entry, reads do not refresh entries.
+	EvictFIFO
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictFIFO:
+		return "fifo"
+	}
+	return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+}
+
+// Storage is the engine a Group's caches keep values in.
+type Storage int
+
+const (
+	// StorageLRU keeps values in an lru.Cache: exact LRU, any size, but
+	// several pointers per entry for the GC to scan.
+	StorageLRU Storage = iota
+	// StorageRing keeps values serialized in preallocated ring buffers,
+	// see package ringcache: approximate LRU and no pointers per entry,
+	// for millions of small values. CacheBytes is allocated up front.
+	StorageRing
+)
+
+func (s Storage) String() string {
+	switch s {
+	case StorageLRU:
+		return "lru"
+	case StorageRing:
+		return "ring"
+	}
+	return fmt.Sprintf("Storage(%d)", int(s))
+}
+
+// A Logger receives a Group's log messages, *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Hooks are called on cache events of a Group, any of them may be nil.
+// They run synchronously on the caller's goroutine and must be fast.
+type Hooks struct {
+	// OnHit is called when Get finds key in this node's cache.
+	OnHit func(key string)
+	// OnMiss is called when Get has to load key.
+	OnMiss func(key string)
+	// OnLoad is called after the Getter was called for key.
+	OnLoad func(key string, d time.Duration, err error)
+	// OnEvict is called when key leaves the main cache: evicted to make
+	// room, expired or removed.
+	OnEvict func(key string)
+}
+
+// GroupConfig is the configuration of a Group, set by GroupOptions.
+type GroupConfig struct {
+	// CacheBytes is the byte budget of the group's caches, 0 means no limit.
+	CacheBytes int64
+	// MaxEntries limits the number of cached items, 0 means no limit.
+	MaxEntries int
+	// Eviction is the policy used when a limit is reached.
+	Eviction EvictionPolicy
+	// Storage is the engine of the main and hot caches.
+	Storage Storage
+	// EntryOverhead is the memory charged per cached item on top of its key
+	// and value, so that CacheBytes bounds the real memory used.
+	EntryOverhead int64
+	// DefaultTTL applies to values loaded or set with a zero expire time,
+	// 0 means they never expire.
+	DefaultTTL time.Duration
+	// HotCacheRatio is the share of CacheBytes kept for values owned by
+	// peers, to save network hops for hot keys. 0 disables the hot cache.
+	HotCacheRatio float64
+	// NegativeTTL is how long ErrNotFound results are cached,
+	// 0 disables negative caching.
+	NegativeTTL time.Duration
+	// Compression compresses loaded and set values of at least
+	// CompressThreshold bytes before they are cached.
+	Compression       Compression
+	CompressThreshold int
+	// LoadConcurrency bounds concurrent Getter calls, further loads wait in
+	// a queue configured by LoadQueue. 0 means no limit.
+	LoadConcurrency int
+	// LoadQueue bounds the loads waiting for one of LoadConcurrency slots,
+	// loads it rejects fail with ErrOverloaded.
+	LoadQueue limiter.Options
+	// LoadLimiter bounds concurrent Getter calls instead of LoadConcurrency,
+	// loads it rejects fail with ErrOverloaded. nil if not set.
+	LoadLimiter limiter.Limiter
+	// TTLJitter shortens every TTL by a random fraction up to TTLJitter,
+	// so that keys loaded together do not expire together. 0 disables it.
+	TTLJitter float64
+	// EarlyExpiration is the XFetch beta of the main and hot caches,
+	// 0 disables early expiration.
+	EarlyExpiration float64
+	// LeaseWait is how long to wait for the lease holder when a key's
+	// owner is unreachable, 0 disables leases.
+	LeaseWait time.Duration
+	// Retry retries transient peer errors, the zero value makes a single attempt.
+	Retry RetryPolicy
+	// Hedging races slow peer requests against a local load,
+	// a zero Percentile disables it.
+	Hedging HedgePolicy
+	// Hooks are called on cache events.
+	Hooks Hooks
+	// Logger receives log messages, it defaults to log.Default().
+	Logger Logger
+	// Memory shares a byte budget with other groups, nil if not set.
+	Memory *MemoryManager
+	// MemoryShare is the group's part in Memory's budget.
+	MemoryShare MemoryShare
+}
+
+// A GroupOption configures a Group created by NewGroup.
+type GroupOption func(*GroupConfig) error
+
+// WithCacheBytes sets the byte budget of the group's caches.
+func WithCacheBytes(n int64) GroupOption {
+	return func(c *GroupConfig) error {
+		if n < 0 {
+			return fmt.Errorf("cache bytes must be >= 0, got %d", n)
+		}
+		c.CacheBytes = n
+		return nil
+	}
+}
+
+// WithMaxEntries limits the number of items cached by the group.
+func WithMaxEntries(n int) GroupOption {
+	return func(c *GroupConfig) error {
+		if n < 0 {
+			return fmt.Errorf("max entries must be >= 0, got %d", n)
+		}
+		c.MaxEntries = n
+		return nil
+	}
+}
+
+// WithEntryOverhead sets the memory charged per cached item besides its key
+// and value. The default is estimated from the sizes of the cache's
+// structures, 0 charges keys and values only.
+func WithEntryOverhead(n int64) GroupOption {
+	return func(c *GroupConfig) error {
+		if n < 0 {
+			return fmt.Errorf("entry overhead must be >= 0, got %d", n)
+		}
+		c.EntryOverhead = n
+		return nil
+	}
+}
+
+// WithStorage selects the storage engine, the default is StorageLRU.
+// StorageRing requires a byte budget and does not support MaxEntries.
+func WithStorage(st Storage) GroupOption {
+	return func(c *GroupConfig) error {
+		if st != StorageLRU && st != StorageRing {
+			return fmt.Errorf("unknown storage %v", st)
+		}
+		c.Storage = st
+		return nil
+	}
+}
+
+// WithEviction sets the eviction policy, the default is EvictLRU.
+func WithEviction(p EvictionPolicy) GroupOption {
+	return func(c *GroupConfig) error {
+		if p != EvictLRU && p != EvictFIFO {
+			return fmt.Errorf("unknown eviction policy %v", p)
+		}
+		c.Eviction = p
+		return nil
+	}
+}
+
+// WithDefaultTTL sets the TTL of values loaded or set without an expire time.
+func WithDefaultTTL(ttl time.Duration) GroupOption {
+	return func(c *GroupConfig) error {
+		if ttl < 0 {
+			return fmt.Errorf("default ttl must be >= 0, got %v", ttl)
+		}
+		c.DefaultTTL = ttl
+		return nil
+	}
+}
+
+// WithHotCacheRatio keeps ratio of the byte budget for values owned by peers.
+func WithHotCacheRatio(ratio float64) GroupOption {
+	return func(c *GroupConfig) error {
+		if ratio < 0 || ratio >= 1 {
+			return fmt.Errorf("hot cache ratio must be in [0, 1), got %v", ratio)
+		}
+		c.HotCacheRatio = ratio
+		return nil
+	}
+}
+
+// WithNegativeTTL caches ErrNotFound results for ttl.
+func WithNegativeTTL(ttl time.Duration) GroupOption {
+	return func(c *GroupConfig) error {
+		if ttl < 0 {
+			return fmt.Errorf("negative ttl must be >= 0, got %v", ttl)
+		}
+		c.NegativeTTL = ttl
+		return nil
+	}
+}
+
+// WithLoadConcurrency bounds the number of concurrent Getter calls to n.
+// Up to queue.QueueSize further loads wait for up to queue.QueueTimeout,
+// the others fail fast with ErrOverloaded.
+func WithLoadConcurrency(n int, queue limiter.Options) GroupOption {
+	return func(c *GroupConfig) error {
+		if n < 0 {
+			return fmt.Errorf("load concurrency must be >= 0, got %d", n)
+		}
+		if queue.QueueSize < 0 || queue.QueueTimeout < 0 {
+			return fmt.Errorf("load queue must not be negative, got %+v", queue)
+		}
+		c.LoadConcurrency, c.LoadQueue = n, queue
+		return nil
+	}
+}
+
+// WithLoadLimiter bounds the number of concurrent Getter calls with l,
+// loads beyond its limit fail fast with ErrOverloaded.
+// It can not be combined with WithLoadConcurrency.
+func WithLoadLimiter(l limiter.Limiter) GroupOption {
+	return func(c *GroupConfig) error {
+		if l == nil {
+			return fmt.Errorf("nil load limiter")
+		}
+		c.LoadLimiter = l
+		return nil
+	}
+}
+
+// WithTTLJitter makes every TTL shorter by a random fraction up to jitter,
+// e.g. 0.1 spreads a 60s TTL over [54s, 60s].
+func WithTTLJitter(jitter float64) GroupOption {
+	return func(c *GroupConfig) error {
+		if jitter < 0 || jitter >= 1 {
+			return fmt.Errorf("ttl jitter must be in [0, 1), got %v", jitter)
+		}
+		c.TTLJitter = jitter
+		return nil
+	}
+}
+
+// WithEarlyExpiration enables XFetch probabilistic early recomputation.
+// Entries close to expiring are reported as misses with a probability that
+// grows with their recorded load duration; beta > 1 favors earlier reloads.
+// beta = 0 disables it.
+func WithEarlyExpiration(beta float64) GroupOption {
+	return func(c *GroupConfig) error {
+		if beta < 0 {
+			return fmt.Errorf("early expiration beta must be >= 0, got %v", beta)
+		}
+		c.EarlyExpiration = beta
+		return nil
+	}
+}
+
+// WithLeaseWait enables cluster-wide coalescing when a key's owner is
+// unreachable: only the node holding a lease loads the key, the others wait
+// up to wait for its result before loading it themselves.
+func WithLeaseWait(wait time.Duration) GroupOption {
+	return func(c *GroupConfig) error {
+		if wait < 0 {
+			return fmt.Errorf("lease wait must be >= 0, got %v", wait)
+		}
+		c.LeaseWait = wait
+		return nil
+	}
+}
+
+// WithHooks sets the hooks called on cache events.
+func WithHooks(h Hooks) GroupOption {
+	return func(c *GroupConfig) error {
+		c.Hooks = h
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the group.
+func WithLogger(l Logger) GroupOption {
+	return func(c *GroupConfig) error {
+		if l == nil {
+			return fmt.Errorf("nil logger")
+		}
+		c.Logger = l
+		return nil
+	}
+}
+
+// WithCompression compresses values of at least threshold bytes with c,
+// threshold = 0 uses a default of 1KB. CacheBytes then counts the
+// compressed size.
+func WithCompression(c Compression, threshold int) GroupOption {
+	return func(cfg *GroupConfig) error {
+		if c < CompressNone || c > CompressFlate {
+			return fmt.Errorf("unknown compression %v", c)
+		}
+		if threshold < 0 {
+			return fmt.Errorf("compress threshold must be >= 0, got %d", threshold)
+		}
+		if threshold == 0 {
+			threshold = defaultCompressThreshold
+		}
+		cfg.Compression, cfg.CompressThreshold = c, threshold
+		return nil
+	}
+}
+
+// WithRetryPolicy makes peer calls retry transient errors before
+// falling back to a local load.
+func WithRetryPolicy(policy RetryPolicy) GroupOption {
+	return func(c *GroupConfig) error {
+		if policy.MaxAttempts < 0 {
+			return fmt.Errorf("retry max attempts must be >= 0, got %d", policy.MaxAttempts)
+		}
+		c.Retry = policy
+		return nil
+	}
+}
+
+// WithHedging enables hedged peer requests: if the owner has not answered
+// within the policy's latency percentile, the value is also loaded locally
+// and the first answer wins.
+func WithHedging(policy HedgePolicy) GroupOption {
+	return func(c *GroupConfig) error {
+		if policy.Percentile <= 0 || policy.Percentile > 1 {
+			return fmt.Errorf("hedge percentile must be in (0, 1], got %v", policy.Percentile)
+		}
+		if policy.Budget < 0 || policy.Budget > 1 {
+			return fmt.Errorf("hedge budget must be in [0, 1], got %v", policy.Budget)
+		}
+		if policy.MinDelay < 0 || policy.MaxDelay < 0 {
+			return fmt.Errorf("hedge delays must be >= 0, got %v and %v", policy.MinDelay, policy.MaxDelay)
+		}
+		c.Hedging = policy
+		return nil
+	}
+}
+
+// WithMemoryManager makes the group's caches part of m's budget,
+// in addition to its own limits. It can not be combined with StorageRing,
+// whose memory is allocated up front and not freed by evictions.
+func WithMemoryManager(m *MemoryManager, share MemoryShare) GroupOption {
+	return func(c *GroupConfig) error {
+		if m == nil {
+			return fmt.Errorf("nil memory manager")
+		}
+		if share.Weight < 0 || share.Min < 0 || share.Max < 0 {
+			return fmt.Errorf("memory share must not be negative, got %+v", share)
+		}
+		if share.Max > 0 && share.Min > share.Max {
+			return fmt.Errorf("memory share min %d > max %d", share.Min, share.Max)
+		}
+		if share.Weight == 0 {
+			share.Weight = 1
+		}
+		c.Memory = m
+		c.MemoryShare = share
+		return nil
+	}
+}
+
+func newGroupConfig(opts []GroupOption) (GroupConfig, error) {
+	c := GroupConfig{EntryOverhead: defaultEntryOverhead, Logger: log.Default()}
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return GroupConfig{}, fmt.Errorf("dcache: %w", err)
+		}
+	}
+	if c.Storage == StorageRing && (c.CacheBytes == 0 || c.MaxEntries != 0) {
+		return GroupConfig{}, fmt.Errorf("dcache: ring storage needs a byte budget and no entry limit")
+	}
+	if c.HotCacheRatio > 0 && c.CacheBytes == 0 && c.MaxEntries == 0 {
+		return GroupConfig{}, fmt.Errorf("dcache: hot cache needs a byte or entry limit")
+	}
+	// ring的内存在第一次写入时一次性分配, 淘汰不会释放堆内存
+	if c.Memory != nil && c.Storage == StorageRing {
+		return GroupConfig{}, fmt.Errorf("dcache: ring storage can not take part in a memory manager")
+	}
+	if c.LoadLimiter != nil && c.LoadConcurrency != 0 {
+		return GroupConfig{}, fmt.Errorf("dcache: load limiter and load concurrency are exclusive")
+	}
+	return c, nil
+}
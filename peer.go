@@ -1,6 +1,9 @@
 package dcache
 
-import "dcache/pb"
+import (
+	"context"
+	"dcache/pb"
+)
 
 // PeerPicker is the interface that must be implemented to locate
 // the peer that owns a specific key.
@@ -14,5 +17,18 @@ type PeerPicker interface {
 // }
 
 type PeerGetter interface {
-	Get(in *pb.Request, out *pb.Response) error
+	Get(ctx context.Context, in *pb.Request, out *pb.Response) error
+}
+
+// FallbackPicker is implemented by a PeerPicker that can name the node
+// arbitrating loads for a key while its owner is unreachable.
+// ok is false when this node is the arbiter itself.
+type FallbackPicker interface {
+	PickFallback(key string) (peer PeerGetter, ok bool)
+}
+
+// LeaseGetter is implemented by a PeerGetter that can hand out load leases.
+type LeaseGetter interface {
+	Lease(ctx context.Context, in *pb.LeaseRequest, out *pb.LeaseResponse) error
+	Release(ctx context.Context, in *pb.LeaseRequest, out *pb.LeaseResponse) error
 }
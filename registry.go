@@ -0,0 +1,111 @@
+package dcache
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrGroupClosed is returned by a Group's methods once it has been closed.
+var ErrGroupClosed = errors.New("dcache: group closed")
+
+// A Registry owns a set of groups by name. Pools serve the groups of the
+// registry they are bound to, so separate registries are isolated from
+// each other, e.g. between tests.
+type Registry struct {
+	mu     sync.RWMutex
+	groups map[string]*Group
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{groups: make(map[string]*Group)}
+}
+
+// DefaultRegistry is the registry used by the package-level functions
+// and by pools created without one.
+var DefaultRegistry = NewRegistry()
+
+// NewGroup creates a group in r configured by opts. It fails if getter is
+// nil, an option is invalid or r already has a group with the same name,
+// Close or DeleteGroup it first to replace it.
+func (r *Registry) NewGroup(name string, getter Getter, opts ...GroupOption) (*Group, error) {
+	if getter == nil {
+		return nil, errors.New("dcache: nil Getter")
+	}
+	config, err := newGroupConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.groups[name]; ok {
+		return nil, fmt.Errorf("dcache: duplicate group %q", name)
+	}
+	g := newGroup(name, getter, config)
+	g.registry = r
+	r.groups[name] = g
+	if config.Memory != nil {
+		config.Memory.register(g, config.MemoryShare)
+	}
+	return g, nil
+}
+
+// GetGroup returns the named group previously created with r.NewGroup,
+// or nil if there's no such group.
+func (r *Registry) GetGroup(name string) *Group {
+	r.mu.RLock()
+	g := r.groups[name]
+	r.mu.RUnlock()
+	return g
+}
+
+// DeleteGroup closes the named group and removes it from r.
+// It reports whether there was such a group.
+func (r *Registry) DeleteGroup(name string) bool {
+	g := r.GetGroup(name)
+	if g == nil {
+		return false
+	}
+	g.Close()
+	return true
+}
+
+// Groups returns the groups of r sorted by name.
+func (r *Registry) Groups() []*Group {
+	r.mu.RLock()
+	list := make([]*Group, 0, len(r.groups))
+	for _, g := range r.groups {
+		list = append(list, g)
+	}
+	r.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// remove drops g from r unless the name has been reused since
+func (r *Registry) remove(g *Group) {
+	r.mu.Lock()
+	if r.groups[g.name] == g {
+		delete(r.groups, g.name)
+	}
+	r.mu.Unlock()
+}
+
+// NewGroup creates a group in DefaultRegistry configured by opts.
+func NewGroup(name string, getter Getter, opts ...GroupOption) (*Group, error) {
+	return DefaultRegistry.NewGroup(name, getter, opts...)
+}
+
+// GetGroup returns the named group of DefaultRegistry, or nil if there's
+// no such group.
+func GetGroup(name string) *Group {
+	return DefaultRegistry.GetGroup(name)
+}
+
+// DeleteGroup closes the named group of DefaultRegistry and removes it.
+// It reports whether there was such a group.
+func DeleteGroup(name string) bool {
+	return DefaultRegistry.DeleteGroup(name)
+}
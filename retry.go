@@ -0,0 +1,147 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Backoff returns how long to wait before the n-th retry, n starts at 1.
+type Backoff interface {
+	Backoff(n int) time.Duration
+}
+
+// ExponentialBackoff waits Base * 2^(n-1), capped at Max.
+// Jitter in [0, 1] randomizes that fraction of each delay, 1 is "full jitter".
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+func (b ExponentialBackoff) Backoff(n int) time.Duration {
+	d := float64(b.Base) * math.Pow(2, float64(n-1))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	d -= rand.Float64() * b.Jitter * d
+	return time.Duration(d)
+}
+
+// RetryPolicy configures retries of PeerGetter calls.
+type RetryPolicy struct {
+	// MaxAttempts including the first one, <= 1 disables retries
+	MaxAttempts int
+	Backoff     Backoff
+	// Retryable classifies errors, defaults to IsRetryable
+	Retryable func(error) bool
+	// Budget limits retries across all calls, nil means unlimited
+	Budget *RetryBudget
+}
+
+// IsRetryable reports whether err is a transient peer error: a reset or
+// refused connection, a timeout, gRPC Unavailable/Aborted or HTTP 502/503/504.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		switch se.Code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.Aborted:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (p *RetryPolicy) do(ctx context.Context, fn func() error) error {
+	if p == nil {
+		return fn()
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	p.Budget.deposit()
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil || n >= p.MaxAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		if !p.Budget.withdraw() {
+			return err
+		}
+		if p.Backoff != nil {
+			timer := time.NewTimer(p.Backoff.Backoff(n))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// RetryBudget is a token bucket shared by all calls: every call deposits
+// Ratio tokens and every retry withdraws one, so retries stay below Ratio
+// of the traffic and cannot snowball into a retry storm.
+type RetryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+// NewRetryBudget allows retries for up to ratio of calls, with bursts of
+// up to max retries. The bucket starts full.
+func NewRetryBudget(ratio, max float64) *RetryBudget {
+	return &RetryBudget{ratio: ratio, max: max, tokens: max}
+}
+
+func (b *RetryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens = math.Min(b.tokens+b.ratio, b.max)
+	b.mu.Unlock()
+}
+
+func (b *RetryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
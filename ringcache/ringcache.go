@@ -0,0 +1,431 @@
+// Package ringcache is a cache storing entries serialized in preallocated
+// byte-slice ring buffers, in the spirit of bigcache and freecache.
+//
+// lru.Cache keeps a list.Element, an entry and a map slot with pointers for
+// every key, with millions of small entries the GC has to scan all of them.
+// Here each shard is one []byte ring plus a map[uint64]uint32 from key hash
+// to offset in the ring, neither holds pointers so the GC never looks inside.
+//
+// 新写入的entry追加在环尾, 空间不足时从环头淘汰. 被读取过的entry在环头时会被
+// 重新追加到环尾一次(second chance/CLOCK), 以此近似LRU.
+package ringcache
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// header layout of an entry in a ring, followed by the key and the value
+//
+//	[0:8]   key hash
+//	[8:16]  expire time in unix nanoseconds, 0 never expires
+//	[16:24] load duration for XFetch, in nanoseconds
+//	[24:28] value length
+//	[28:30] key length
+//	[30]    flags
+const (
+	headerSize = 32
+
+	flagAccessed = 1 << 0
+
+	// MaxKeyLen is the longest key the cache accepts.
+	MaxKeyLen = math.MaxUint16
+
+	// maxReinserts bounds how many accessed entries are given a second
+	// chance while making room for one Set
+	maxReinserts = 5
+
+	// mapSlotOverhead estimates the bytes of an index slot: hash, offset and
+	// a control byte at a 7/8 load factor
+	mapSlotOverhead = (8 + 4 + 1) * 8 / 7
+
+	defaultShards = 256
+	minShardBytes = 64 << 10
+)
+
+// Options configures a Cache.
+type Options struct {
+	// Shards is the number of independently locked rings, rounded up to a
+	// power of two. If blank, it is 256, fewer for small caches so that
+	// every shard holds at least 64KB.
+	Shards int
+}
+
+// Cache is a sharded ring buffer cache, it is safe for concurrent use.
+// An entry must fit in one shard, i.e. be smaller than maxBytes / Shards.
+type Cache struct {
+	shards []shard
+	mask   uint64
+	next   uint32 // shard RemoveOldest tries first, round robin
+
+	// optional and executed when a live entry leaves the cache,
+	// with the shard's lock held.
+	OnEvicted func(key string)
+
+	// Now returns the current time, defaults to time.Now
+	Now func() time.Time
+
+	// FIFO evicts entries in insertion order: Get does not give entries
+	// a second chance.
+	FIFO bool
+
+	// Beta enables XFetch probabilistic early expiration when > 0,
+	// see lru.Cache.Beta.
+	Beta float64
+	// Rand returns a float in [0.0, 1.0), defaults to math/rand.Float64
+	Rand func() float64
+}
+
+type shard struct {
+	mu    sync.Mutex
+	buf   []byte
+	begin uint64 // logical offset of the oldest entry
+	end   uint64 // logical offset entries are appended at
+	index map[uint64]uint32
+	data  int64  // bytes of keys and values of live entries
+	tmp   []byte // scratch space for reinserting entries
+}
+
+// Stats describes the memory a Cache uses.
+type Stats struct {
+	Entries  int
+	Data     int64 // bytes of live keys and values
+	Overhead int64 // estimated bytes of headers and index slots of live entries
+	Bytes    int64 // Data + Overhead
+	Capacity int64 // bytes preallocated for the rings
+}
+
+// New allocates a Cache of maxBytes split over shards.
+func New(maxBytes int64, opts Options) *Cache {
+	n := opts.Shards
+	if n <= 0 {
+		n = defaultShards
+		for n > 1 && maxBytes/int64(n) < minShardBytes {
+			n /= 2
+		}
+	}
+	// round up to a power of two so that a mask selects the shard
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	// 太小的shard放不下任何entry, 和maxBytes过小的lru.Cache一样总是miss
+	shardBytes := max(maxBytes/int64(size), 1)
+	if shardBytes > math.MaxUint32 {
+		panic("ringcache: shard larger than 4GB")
+	}
+
+	c := &Cache{
+		shards: make([]shard, size),
+		mask:   uint64(size - 1),
+		Now:    time.Now,
+		Rand:   rand.Float64,
+	}
+	for i := range c.shards {
+		c.shards[i].buf = make([]byte, shardBytes)
+		c.shards[i].index = make(map[uint64]uint32)
+	}
+	return c
+}
+
+// hash is FNV-1a, inlined to avoid allocating a hash.Hash64 per call
+func hash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (c *Cache) shardOf(h uint64) *shard {
+	return &c.shards[h&c.mask]
+}
+
+// Set adds a value to the cache, delta is how long it took to load and
+// drives the XFetch early expiration. It reports whether the entry fit,
+// the previous value of key is removed either way.
+func (c *Cache) Set(key string, value []byte, expire time.Time, delta time.Duration) bool {
+	h := hash(key)
+	s := c.shardOf(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 64位hash冲突时被挤掉的是另一个key, 要通知OnEvicted
+	_, _, same := s.lookup(h, key)
+	s.remove(c, h, !same)
+	n := uint64(headerSize + len(key) + len(value))
+	if len(key) > MaxKeyLen || len(value) > math.MaxUint32 || n > uint64(len(s.buf)) {
+		return false
+	}
+
+	reinserts := 0
+	for uint64(len(s.buf))-(s.end-s.begin) < n {
+		if _, reinserted := s.evictHead(c, reinserts < maxReinserts); reinserted {
+			reinserts++
+		}
+	}
+
+	var hdr [headerSize]byte
+	binary.LittleEndian.PutUint64(hdr[0:], h)
+	if !expire.IsZero() {
+		binary.LittleEndian.PutUint64(hdr[8:], uint64(expire.UnixNano()))
+	}
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(delta))
+	binary.LittleEndian.PutUint32(hdr[24:], uint32(len(value)))
+	binary.LittleEndian.PutUint16(hdr[28:], uint16(len(key)))
+
+	s.index[h] = s.phys(s.end)
+	s.writeAt(hdr[:], s.end)
+	s.writeAt([]byte(key), s.end+headerSize)
+	s.writeAt(value, s.end+headerSize+uint64(len(key)))
+	s.end += n
+	s.data += int64(len(key) + len(value))
+	return true
+}
+
+// Get looks up a key's value, the returned slice is a copy.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	h := hash(key)
+	s := c.shardOf(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	off, hdr, ok := s.lookup(h, key)
+	if !ok {
+		return nil, false
+	}
+	now := c.Now()
+	expire := expireOf(hdr)
+	if !expire.IsZero() && expire.Before(now) {
+		s.remove(c, h, true)
+		return nil, false
+	}
+	// 提前过期只返回miss, 不删除元素
+	if c.expireEarly(expire, time.Duration(binary.LittleEndian.Uint64(hdr[16:])), now) {
+		return nil, false
+	}
+	if !c.FIFO && hdr[30]&flagAccessed == 0 {
+		s.writeAt([]byte{hdr[30] | flagAccessed}, off+30)
+	}
+	return s.value(off, hdr), true
+}
+
+// Peek returns a key's value and expire time without marking it as used,
+// an expired entry is reported as missing.
+func (c *Cache) Peek(key string) ([]byte, time.Time, bool) {
+	h := hash(key)
+	s := c.shardOf(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	off, hdr, ok := s.lookup(h, key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	expire := expireOf(hdr)
+	if !expire.IsZero() && expire.Before(c.Now()) {
+		return nil, time.Time{}, false
+	}
+	return s.value(off, hdr), expire, true
+}
+
+// Remove removes the provided key from the cache.
+func (c *Cache) Remove(key string) {
+	h := hash(key)
+	s := c.shardOf(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, ok := s.lookup(h, key); ok {
+		s.remove(c, h, true)
+	}
+}
+
+// RemoveOldest evicts the oldest entry of one of the shards, taking turns.
+// It reports whether there was an entry to evict.
+func (c *Cache) RemoveOldest() bool {
+	for range c.shards {
+		s := &c.shards[uint64(atomic.AddUint32(&c.next, 1))&c.mask]
+		s.mu.Lock()
+		for s.begin < s.end {
+			if evicted, _ := s.evictHead(c, false); evicted {
+				s.mu.Unlock()
+				return true
+			}
+		}
+		s.mu.Unlock()
+	}
+	return false
+}
+
+// Clear purges all stored items from the cache.
+func (c *Cache) Clear() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for s.begin < s.end {
+			s.evictHead(c, false)
+		}
+		s.begin, s.end = 0, 0
+		s.mu.Unlock()
+	}
+}
+
+// MaxEntryLen returns the longest key plus value that fits in a shard.
+func (c *Cache) MaxEntryLen() int {
+	return len(c.shards[0].buf) - headerSize
+}
+
+// Len returns the number of items in the cache.
+func (c *Cache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += len(s.index)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Stats returns the estimated memory used by the cache.
+func (c *Cache) Stats() Stats {
+	var st Stats
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		st.Entries += len(s.index)
+		st.Data += s.data
+		st.Capacity += int64(len(s.buf))
+		s.mu.Unlock()
+	}
+	st.Overhead = int64(st.Entries) * (headerSize + mapSlotOverhead)
+	st.Bytes = st.Data + st.Overhead
+	return st
+}
+
+// expireEarly implements the XFetch check, see lru.Cache.expireEarly
+func (c *Cache) expireEarly(expire time.Time, delta time.Duration, now time.Time) bool {
+	if c.Beta <= 0 || expire.IsZero() || delta <= 0 {
+		return false
+	}
+	r := c.Rand()
+	if r <= 0 {
+		return true // ln(0) = -inf
+	}
+	gap := time.Duration(-float64(delta) * c.Beta * math.Log(r))
+	return !now.Add(gap).Before(expire)
+}
+
+func expireOf(hdr []byte) time.Time {
+	if ns := binary.LittleEndian.Uint64(hdr[8:]); ns != 0 {
+		return time.Unix(0, int64(ns))
+	}
+	return time.Time{}
+}
+
+func (s *shard) phys(off uint64) uint32 {
+	return uint32(off % uint64(len(s.buf)))
+}
+
+// readAt and writeAt copy p from/to the ring at logical offset off,
+// wrapping around the end of buf
+func (s *shard) readAt(p []byte, off uint64) {
+	n := copy(p, s.buf[s.phys(off):])
+	copy(p[n:], s.buf)
+}
+
+func (s *shard) writeAt(p []byte, off uint64) {
+	n := copy(s.buf[s.phys(off):], p)
+	copy(s.buf, p[n:])
+}
+
+// logical converts a physical offset of a live entry back to a logical one
+func (s *shard) logical(p uint32) uint64 {
+	off := s.begin - uint64(s.phys(s.begin)) + uint64(p)
+	if off < s.begin {
+		off += uint64(len(s.buf))
+	}
+	return off
+}
+
+// lookup returns the logical offset and header of key's entry
+func (s *shard) lookup(h uint64, key string) (uint64, []byte, bool) {
+	p, ok := s.index[h]
+	if !ok {
+		return 0, nil, false
+	}
+	off := s.logical(p)
+	hdr := make([]byte, headerSize)
+	s.readAt(hdr, off)
+	if int(binary.LittleEndian.Uint16(hdr[28:])) != len(key) {
+		return 0, nil, false
+	}
+	k := make([]byte, len(key))
+	s.readAt(k, off+headerSize)
+	if string(k) != key {
+		return 0, nil, false // 64位hash冲突
+	}
+	return off, hdr, true
+}
+
+func (s *shard) value(off uint64, hdr []byte) []byte {
+	v := make([]byte, binary.LittleEndian.Uint32(hdr[24:]))
+	s.readAt(v, off+headerSize+uint64(binary.LittleEndian.Uint16(hdr[28:])))
+	return v
+}
+
+// remove drops the index entry of hash h, its bytes are reclaimed when
+// the head of the ring passes them
+func (s *shard) remove(c *Cache, h uint64, notify bool) {
+	p, ok := s.index[h]
+	if !ok {
+		return
+	}
+	off := s.logical(p)
+	var hdr [headerSize]byte
+	s.readAt(hdr[:], off)
+	kl := binary.LittleEndian.Uint16(hdr[28:])
+	delete(s.index, h)
+	s.data -= int64(kl) + int64(binary.LittleEndian.Uint32(hdr[24:]))
+	if notify && c.OnEvicted != nil {
+		key := make([]byte, kl)
+		s.readAt(key, off+headerSize)
+		c.OnEvicted(string(key))
+	}
+}
+
+// evictHead frees the entry at the head of the ring. If reinsert is set and
+// the entry was read since it was written, it moves to the tail instead.
+// It reports whether a live entry was evicted, or else reinserted.
+func (s *shard) evictHead(c *Cache, reinsert bool) (evicted, reinserted bool) {
+	var hdr [headerSize]byte
+	s.readAt(hdr[:], s.begin)
+	h := binary.LittleEndian.Uint64(hdr[0:])
+	n := uint64(headerSize) + uint64(binary.LittleEndian.Uint16(hdr[28:])) + uint64(binary.LittleEndian.Uint32(hdr[24:]))
+	p, ok := s.index[h]
+	live := ok && p == s.phys(s.begin)
+	if !live {
+		s.begin += n
+		return false, false
+	}
+
+	expire := expireOf(hdr[:])
+	if reinsert && hdr[30]&flagAccessed != 0 && (expire.IsZero() || !expire.Before(c.Now())) {
+		if cap(s.tmp) < int(n) {
+			s.tmp = make([]byte, n)
+		}
+		tmp := s.tmp[:n]
+		s.readAt(tmp, s.begin)
+		tmp[30] &^= flagAccessed
+		s.begin += n
+		s.index[h] = s.phys(s.end)
+		s.writeAt(tmp, s.end)
+		s.end += n
+		return false, true
+	}
+	s.remove(c, h, true)
+	s.begin += n
+	return true, false
+}
@@ -4,59 +4,265 @@ import (
 	"context"
 	"dcache/consistenthash"
 	"dcache/pb"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type grpcGetter struct {
 	addr string
+	opts []grpc.DialOption
+
+	once   sync.Once // 连接只建立一次, 之后的调用复用
+	conn   *grpc.ClientConn
+	client pb.GroupCacheClient
+	err    error
+}
+
+// errPeerRemoved is returned by a grpcGetter closed by GrpcPool.Set
+var errPeerRemoved = errors.New("dcache: peer removed")
+
+func (g *grpcGetter) dial() (pb.GroupCacheClient, error) {
+	g.once.Do(func() {
+		// 用户的DialOption放在后面, 可以覆盖默认的insecure credentials
+		opts := append([]grpc.DialOption{grpc.WithInsecure()}, g.opts...)
+		c, err := grpc.Dial(g.addr, opts...)
+		if err != nil {
+			g.err = err
+			return
+		}
+		g.conn = c
+		g.client = pb.NewGroupCacheClient(c)
+	})
+	return g.client, g.err
+}
+
+// close closes the connection of a getter that left the pool,
+// it is not dialed afterwards
+func (g *grpcGetter) close() {
+	g.once.Do(func() { g.err = errPeerRemoved })
+	if g.conn != nil {
+		g.conn.Close()
+	}
 }
 
-func (g *grpcGetter) Get(in *pb.Request, out *pb.Response) error {
-	c, err := grpc.Dial(g.addr, grpc.WithInsecure())
+// Get streams the value with GetStream, peers that do not implement it
+// yet are asked with the unary Get.
+func (g *grpcGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	client, err := g.dial()
 	if err != nil {
 		return err
 	}
-	client := pb.NewGroupCacheClient(c)
-	response, err := client.Get(context.Background(), in)
-	out.Value = response.Value
-	return err
+	response, err := g.getStream(ctx, client, in)
+	if status.Code(err) == codes.Unimplemented {
+		response, err = client.Get(ctx, in)
+	}
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.NotFound:
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	case codes.ResourceExhausted:
+		return fmt.Errorf("%w: %v", ErrOverloaded, err)
+	default:
+		return err
+	}
+	out.Value, out.Compression = response.Value, response.Compression
+	return nil
+}
+
+// getStream receives the chunks of a value and checks them against the
+// size and checksum of the first chunk
+func (g *grpcGetter) getStream(ctx context.Context, client pb.GroupCacheClient, in *pb.Request) (*pb.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.GetStream(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, min(first.Size, maxPrealloc))
+	value = append(value, first.Data...)
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, chunk.Data...)
+	}
+	if uint64(len(value)) != first.Size || checksum(value) != first.Checksum {
+		return nil, fmt.Errorf("%w: %s/%s from %s", ErrChecksum, in.Group, in.Key, g.addr)
+	}
+	return &pb.Response{Value: value, Compression: first.Compression}, nil
+}
+
+func (g *grpcGetter) Lease(ctx context.Context, in *pb.LeaseRequest, out *pb.LeaseResponse) error {
+	client, err := g.dial()
+	if err != nil {
+		return err
+	}
+	response, err := client.Lease(ctx, in)
+	if err != nil {
+		return err
+	}
+	proto.Merge(out, response)
+	return nil
+}
+
+func (g *grpcGetter) Release(ctx context.Context, in *pb.LeaseRequest, out *pb.LeaseResponse) error {
+	client, err := g.dial()
+	if err != nil {
+		return err
+	}
+	response, err := client.Release(ctx, in)
+	if err != nil {
+		return err
+	}
+	proto.Merge(out, response)
+	return nil
 }
 
 var _ PeerGetter = (*grpcGetter)(nil)
+var _ LeaseGetter = (*grpcGetter)(nil)
 
 type GrpcPool struct {
 	pb.UnimplementedGroupCacheServer
 
 	self        string
+	opts        GrpcPoolOptions
 	mu          sync.Mutex
 	peers       *consistenthash.Map
 	grpcGetters map[string]*grpcGetter
 }
 
+// GrpcPoolOptions are the configurations of a GrpcPool.
+type GrpcPoolOptions struct {
+	// Replicas specifies the number of key replicas on the consistent hash.
+	// If blank, it defaults to 50.
+	Replicas int
+
+	// HashFn specifies the hash function of the consistent hash.
+	// If blank, it defaults to crc32.ChecksumIEEE.
+	HashFn consistenthash.Hash
+
+	// DialOptions are used when dialing peers, e.g. transport credentials.
+	DialOptions []grpc.DialOption
+
+	// ServerOptions are used by Run to create the server.
+	ServerOptions []grpc.ServerOption
+
+	// TLS enables mutual TLS both when dialing peers and in Run.
+	TLS *PeerTLS
+
+	// Auth signs RPCs to peers and verifies RPCs served by Run.
+	// If nil, RPCs are not authenticated.
+	Auth Authenticator
+
+	// Registry holds the groups the pool serves.
+	// If nil, it defaults to DefaultRegistry.
+	Registry *Registry
+
+	// ACL restricts the operations each identity may perform per group.
+	// If nil, every RPC is allowed.
+	ACL *ACL
+}
+
 func NewGrpcPool(self string) *GrpcPool {
-	return &GrpcPool{
+	return NewGrpcPoolOpts(self, nil)
+}
+
+// NewGrpcPoolOpts initializes a gRPC pool of peers with the given options.
+func NewGrpcPoolOpts(self string, o *GrpcPoolOptions) *GrpcPool {
+	p := &GrpcPool{
 		self:        self,
-		peers:       consistenthash.New(defaultReplicas, nil),
 		grpcGetters: map[string]*grpcGetter{},
 	}
+	if o != nil {
+		p.opts = *o
+	}
+	if p.opts.Replicas == 0 {
+		p.opts.Replicas = defaultReplicas
+	}
+	if p.opts.Registry == nil {
+		p.opts.Registry = DefaultRegistry
+	}
+	if p.opts.TLS != nil {
+		p.opts.DialOptions = append(p.opts.DialOptions[:len(p.opts.DialOptions):len(p.opts.DialOptions)],
+			grpc.WithTransportCredentials(peerCredentials{p.opts.TLS, credentials.NewTLS(p.opts.TLS.ClientConfig())}))
+		p.opts.ServerOptions = append(p.opts.ServerOptions[:len(p.opts.ServerOptions):len(p.opts.ServerOptions)],
+			grpc.Creds(credentials.NewTLS(p.opts.TLS.ServerConfig())))
+	}
+	if p.opts.Auth != nil {
+		p.opts.DialOptions = append(p.opts.DialOptions[:len(p.opts.DialOptions):len(p.opts.DialOptions)],
+			grpc.WithChainUnaryInterceptor(unaryClientAuth(p.opts.Auth)),
+			grpc.WithChainStreamInterceptor(streamClientAuth(p.opts.Auth)))
+		p.opts.ServerOptions = append(p.opts.ServerOptions[:len(p.opts.ServerOptions):len(p.opts.ServerOptions)],
+			grpc.ChainUnaryInterceptor(unaryServerAuth(p.opts.Auth)),
+			grpc.ChainStreamInterceptor(streamServerAuth(p.opts.Auth)))
+	}
+	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
+	return p
+}
+
+// peerCredentials checks a peer's certificate against the host it is dialed
+// at, SNI is not sent for peers addressed by IP
+type peerCredentials struct {
+	t *PeerTLS
+	credentials.TransportCredentials
+}
+
+func (c peerCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(c.t.clientConfig(hostOf(authority))).ClientHandshake(ctx, authority, conn)
 }
 
+func (c peerCredentials) Clone() credentials.TransportCredentials {
+	return peerCredentials{c.t, c.TransportCredentials.Clone()}
+}
+
+// Set updates the pool's list of peers. Connections to peers still in
+// the list are kept, those to removed peers are closed.
 func (p *GrpcPool) Set(peers ...string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.peers = consistenthash.New(p.opts.Replicas, p.opts.HashFn)
 	p.peers.Add(peers...)
+	if p.opts.TLS != nil {
+		p.opts.TLS.setMembers(peers)
+	}
+	// 地址不变的peer复用已有的连接, 被移除的peer关闭连接
+	getters := make(map[string]*grpcGetter, len(peers))
 	for _, peer := range peers {
-		p.grpcGetters[peer] = &grpcGetter{
+		if g, ok := p.grpcGetters[peer]; ok {
+			getters[peer] = g
+			continue
+		}
+		getters[peer] = &grpcGetter{
 			addr: peer,
+			opts: p.opts.DialOptions,
 		}
 	}
+	for peer, g := range p.grpcGetters {
+		if _, ok := getters[peer]; !ok {
+			g.close()
+		}
+	}
+	p.grpcGetters = getters
 }
 
 func (p *GrpcPool) PickPeer(key string) (PeerGetter, bool) {
@@ -70,6 +276,19 @@ func (p *GrpcPool) PickPeer(key string) (PeerGetter, bool) {
 
 var _ PeerPicker = (*GrpcPool)(nil)
 
+// PickFallback picks the node after the key's owner on the ring, which
+// arbitrates leases for the key while the owner is unreachable
+func (p *GrpcPool) PickFallback(key string) (PeerGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if nodes := p.peers.GetN(key, 2); len(nodes) == 2 && nodes[1] != p.self {
+		return p.grpcGetters[nodes[1]], true
+	}
+	return nil, false
+}
+
+var _ FallbackPicker = (*GrpcPool)(nil)
+
 func (p *GrpcPool) Log(format string, v ...interface{}) {
 	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
 }
@@ -77,29 +296,125 @@ func (p *GrpcPool) Log(format string, v ...interface{}) {
 func (p *GrpcPool) Get(ctx context.Context, in *pb.Request) (*pb.Response, error) {
 	p.Log("%s %s", in.Group, in.Key)
 	response := &pb.Response{}
+	if err := p.allow(ctx, in.Group, OpGet); err != nil {
+		return response, err
+	}
 
-	group := GetGroup(in.Group)
+	group := p.opts.Registry.GetGroup(in.Group)
 	if group == nil {
 		p.Log("no such group %v", in.Group)
 		return response, fmt.Errorf("no such group %v", in.Group)
 	}
-	value, err := group.Get(in.Key, time.Time(time.Unix(0, 0)))
+	group.Stats.ServerRequests.Add(1)
+	value, err := group.get(ctx, in.Key, time.Time{})
+	if err != nil {
+		return response, p.getError(in.Key, err)
+	}
+
+	// value is immutable and gRPC only reads the response, no copy needed
+	b, c, err := value.wire(in.AcceptCompressed)
+	if err != nil {
+		return response, status.Error(codes.DataLoss, group.dropCorrupt(in.Key, err).Error())
+	}
+	response.Value, response.Compression = b, uint32(c)
+	return response, nil
+}
+
+// GetStream sends the value in chunks, the first one carries the size and
+// checksum of the whole value.
+func (p *GrpcPool) GetStream(in *pb.Request, stream grpc.ServerStreamingServer[pb.Chunk]) error {
+	ctx := stream.Context()
+	p.Log("%s %s (stream)", in.Group, in.Key)
+	if err := p.allow(ctx, in.Group, OpGet); err != nil {
+		return err
+	}
+
+	group := p.opts.Registry.GetGroup(in.Group)
+	if group == nil {
+		p.Log("no such group %v", in.Group)
+		return fmt.Errorf("no such group %v", in.Group)
+	}
+	group.Stats.ServerRequests.Add(1)
+	value, err := group.get(ctx, in.Key, time.Time{})
 	if err != nil {
-		p.Log("get key %v error %v", in.Key, err)
+		return p.getError(in.Key, err)
+	}
+
+	b, c, err := value.wire(in.AcceptCompressed)
+	if err != nil {
+		return status.Error(codes.DataLoss, group.dropCorrupt(in.Key, err).Error())
+	}
+	first := &pb.Chunk{Size: uint64(len(b)), Checksum: checksum(b), Compression: uint32(c)}
+	first.Data = b[:min(len(b), transferChunkSize)]
+	if err := stream.Send(first); err != nil {
+		return err
+	}
+	for off := transferChunkSize; off < len(b); off += transferChunkSize {
+		chunk := &pb.Chunk{Data: b[off:min(len(b), off+transferChunkSize)]}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getError maps an error of Group.Get to the status peers expect
+func (p *GrpcPool) getError(key string, err error) error {
+	switch {
+	case errors.Is(err, ErrOverloaded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	p.Log("get key %v error %v", key, err)
+	return err
+}
+
+func (p *GrpcPool) Lease(ctx context.Context, in *pb.LeaseRequest) (*pb.LeaseResponse, error) {
+	response := &pb.LeaseResponse{}
+	if err := p.allow(ctx, in.Group, OpLease); err != nil {
 		return response, err
 	}
+	group := p.opts.Registry.GetGroup(in.Group)
+	if group == nil {
+		return response, fmt.Errorf("no such group %v", in.Group)
+	}
+	group.leases.acquire(in.Key, response)
+	return response, nil
+}
 
-	response.Value = value.ByteSlice()
+func (p *GrpcPool) Release(ctx context.Context, in *pb.LeaseRequest) (*pb.LeaseResponse, error) {
+	response := &pb.LeaseResponse{}
+	if err := p.allow(ctx, in.Group, OpLease); err != nil {
+		return response, err
+	}
+	group := p.opts.Registry.GetGroup(in.Group)
+	if group == nil {
+		return response, fmt.Errorf("no such group %v", in.Group)
+	}
+	group.leases.release(in.Key, in.Token, in.Value)
 	return response, nil
 }
 
+// allow checks the pool's ACL for the caller of the RPC being served
+func (p *GrpcPool) allow(ctx context.Context, group string, op Op) error {
+	if p.opts.ACL == nil {
+		return nil
+	}
+	identity := requestIdentity(ctx, nil)
+	if !p.opts.ACL.Allow(identity, group, op) {
+		return status.Errorf(codes.PermissionDenied, "%v may not %v %v", identity, op, group)
+	}
+	return nil
+}
+
 func (p *GrpcPool) Run() {
 	lis, err := net.Listen("tcp", p.self)
 	if err != nil {
 		panic(err)
 	}
 
-	server := grpc.NewServer()
+	server := grpc.NewServer(p.opts.ServerOptions...)
 	pb.RegisterGroupCacheServer(server, p)
 
 	reflection.Register(server)
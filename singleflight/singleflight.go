@@ -1,6 +1,12 @@
 package singleflight
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
 
 /*
 一瞬间有大量请求get(key), 而且key未被缓存或者未被缓存在当前节点
@@ -8,40 +14,185 @@ import "sync"
 使用singleflight, 第一个get(key)请求到来时, singleflight会记录当前key正在被处理, 后续的请求只需要等待第一个请求处理完成, 取返回值即可
 */
 type call struct {
-	wg  sync.WaitGroup
-	val interface{}
-	err error
+	done chan struct{} // closed when fn returns
+	val  interface{}
+	err  error
+
+	dups   int // number of callers that joined an in-flight call
+	chans  []chan<- Result
+	shared bool // set before done is closed
+	refs   int  // callers still waiting, the leader ctx is canceled when it drops to 0
+	cancel context.CancelFunc
+}
+
+// Result holds the results of Do, so they can be passed on a channel.
+type Result struct {
+	Val    interface{}
+	Err    error
+	Shared bool
+}
+
+// A PanicError is the error returned to every waiter when fn panics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("singleflight: fn panicked: %v\n\n%s", p.Value, p.Stack)
 }
 
+// errGoexit is returned when fn calls runtime.Goexit
+var errGoexit = errors.New("singleflight: fn called runtime.Goexit")
+
 type Group struct {
 	mu sync.Mutex // protects m
 	m  map[string]*call
 }
 
-func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+// Do executes and returns the results of fn, making sure that only one
+// execution is in-flight for a given key at a time. If a duplicate comes in,
+// the duplicate caller waits for the original to complete and receives the
+// same results. shared reports whether v was given to multiple callers.
+// If fn panics, the panic is re-raised in every waiting caller.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
 	g.mu.Lock()
 	if g.m == nil {
 		g.m = make(map[string]*call)
 	}
 	// 后续相同的key进入
 	if c, ok := g.m[key]; ok {
+		c.dups++
+		c.refs++
 		g.mu.Unlock()
-		c.wg.Wait()
-		return c.val, c.err
+		<-c.done
+		return c.result()
 	}
-	c := new(call)
-	c.wg.Add(1)
+	c := newCall()
 	g.m[key] = c
 	g.mu.Unlock()
 
-	c.val, c.err = fn()
-	c.wg.Done()
+	g.doCall(c, key, fn)
+	return c.result()
+}
+
+// DoChan is like Do but returns a channel that will receive the results
+// when they are ready. A panic in fn is delivered as a *PanicError.
+func (g *Group) DoChan(key string, fn func() (interface{}, error)) <-chan Result {
+	ch := make(chan Result, 1)
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		c.refs++
+		c.chans = append(c.chans, ch)
+		g.mu.Unlock()
+		return ch
+	}
+	c := newCall()
+	c.chans = append(c.chans, ch)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	go g.doCall(c, key, fn)
+	return ch
+}
+
+// DoContext is like Do but every caller waits only as long as its own ctx
+// allows. fn runs in its own goroutine with a context detached from the
+// first caller, which is canceled once all waiting callers have given up.
+// One caller's cancellation therefore never fails the others.
+func (g *Group) DoContext(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	c, ok := g.m[key]
+	if ok {
+		c.dups++
+	} else {
+		c = newCall()
+		leaderCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c.cancel = cancel
+		g.m[key] = c
+		go g.doCall(c, key, func() (interface{}, error) {
+			return fn(leaderCtx)
+		})
+	}
+	c.refs++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.result()
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.refs--
+		if c.refs == 0 && c.cancel != nil {
+			// 所有等待者都已离开, 取消leader, 之后的请求重新发起
+			c.cancel()
+			if g.m[key] == c {
+				delete(g.m, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err(), false
+	}
+}
 
+// Forget tells the singleflight to forget about a key. Future calls
+// to Do for this key will call fn rather than waiting for an earlier call.
+func (g *Group) Forget(key string) {
 	g.mu.Lock()
 	delete(g.m, key)
 	g.mu.Unlock()
+}
+
+func newCall() *call {
+	return &call{done: make(chan struct{})}
+}
+
+// doCall runs fn and hands its results to all waiters, even if fn panics
+func (g *Group) doCall(c *call, key string, fn func() (interface{}, error)) {
+	normalReturn := false
+	defer func() {
+		if !normalReturn {
+			if r := recover(); r != nil {
+				c.err = &PanicError{Value: r, Stack: debug.Stack()}
+			} else {
+				c.err = errGoexit
+			}
+		}
+		if c.cancel != nil {
+			c.cancel()
+		}
+
+		g.mu.Lock()
+		c.shared = c.dups > 0
+		if g.m[key] == c {
+			delete(g.m, key)
+		}
+		chans := c.chans
+		g.mu.Unlock()
 
-	return c.val, c.err
+		close(c.done)
+		for _, ch := range chans {
+			ch <- Result{c.val, c.err, c.shared}
+		}
+	}()
+
+	c.val, c.err = fn()
+	normalReturn = true
+}
+
+// result returns the call's results, re-raising a panic from fn
+func (c *call) result() (interface{}, error, bool) {
+	if e, ok := c.err.(*PanicError); ok {
+		panic(e)
+	}
+	return c.val, c.err, c.shared
 }
 
 /*
@@ -0,0 +1,218 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A Sink receives the value of a GetTo call.
+// Cached values reach sinks that can share them without being copied,
+// see ByteViewSink.
+type Sink interface {
+	// SetString sets the value to s.
+	SetString(s string) error
+
+	// SetBytes sets the value to the contents of v.
+	// The caller retains ownership of v.
+	SetBytes(v []byte) error
+
+	// SetProto sets the value to the encoded version of m.
+	// The caller retains ownership of m.
+	SetProto(m proto.Message) error
+}
+
+// viewSetter is implemented by sinks that can take a ByteView without
+// copying it, the view is immutable so it may be shared
+type viewSetter interface {
+	setView(v ByteView) error
+}
+
+func setSinkView(s Sink, v ByteView) error {
+	if vs, ok := s.(viewSetter); ok {
+		return vs.setView(v)
+	}
+	return s.SetBytes(v.data())
+}
+
+// GetTo gets the value for key like Get and delivers it to dest.
+func (g *Group) GetTo(ctx context.Context, key string, expire time.Time, dest Sink) error {
+	view, err := g.Get(ctx, key, expire)
+	if err != nil {
+		return err
+	}
+	return setSinkView(dest, view)
+}
+
+// StringSink returns a Sink that populates the provided string pointer.
+func StringSink(sp *string) Sink {
+	return &stringSink{sp: sp}
+}
+
+type stringSink struct {
+	sp *string
+}
+
+func (s *stringSink) SetString(v string) error {
+	*s.sp = v
+	return nil
+}
+
+func (s *stringSink) SetBytes(v []byte) error {
+	return s.SetString(string(v))
+}
+
+func (s *stringSink) SetProto(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	*s.sp = string(b)
+	return nil
+}
+
+// ByteViewSink returns a Sink that populates a ByteView.
+// Values from the cache are delivered without copying.
+func ByteViewSink(dst *ByteView) Sink {
+	if dst == nil {
+		panic("nil dst")
+	}
+	return &byteViewSink{dst: dst}
+}
+
+type byteViewSink struct {
+	dst *ByteView
+}
+
+func (s *byteViewSink) setView(v ByteView) error {
+	*s.dst = v
+	return nil
+}
+
+func (s *byteViewSink) SetProto(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	*s.dst = ByteView{b: b}
+	return nil
+}
+
+func (s *byteViewSink) SetBytes(b []byte) error {
+	*s.dst = ByteView{b: cloneBytes(b)}
+	return nil
+}
+
+func (s *byteViewSink) SetString(v string) error {
+	*s.dst = ByteView{b: []byte(v)}
+	return nil
+}
+
+// ProtoSink returns a sink that unmarshals binary proto values into m.
+func ProtoSink(m proto.Message) Sink {
+	return &protoSink{dst: m}
+}
+
+type protoSink struct {
+	dst proto.Message
+}
+
+// setView unmarshals straight from the cached bytes,
+// proto.Unmarshal does not retain them
+func (s *protoSink) setView(v ByteView) error {
+	return proto.Unmarshal(v.data(), s.dst)
+}
+
+func (s *protoSink) SetBytes(b []byte) error {
+	return proto.Unmarshal(b, s.dst)
+}
+
+func (s *protoSink) SetString(v string) error {
+	return proto.Unmarshal([]byte(v), s.dst)
+}
+
+func (s *protoSink) SetProto(m proto.Message) error {
+	proto.Reset(s.dst)
+	proto.Merge(s.dst, m)
+	return nil
+}
+
+// AllocatingByteSliceSink returns a Sink that allocates
+// a byte slice to hold the received value and assigns
+// it to *dst. The memory is not retained by dcache.
+func AllocatingByteSliceSink(dst *[]byte) Sink {
+	return &allocBytesSink{dst: dst}
+}
+
+type allocBytesSink struct {
+	dst *[]byte
+}
+
+func (s *allocBytesSink) SetProto(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setBytesOwned(b)
+}
+
+func (s *allocBytesSink) SetBytes(b []byte) error {
+	return s.setBytesOwned(cloneBytes(b))
+}
+
+func (s *allocBytesSink) SetString(v string) error {
+	return s.setBytesOwned([]byte(v))
+}
+
+func (s *allocBytesSink) setBytesOwned(b []byte) error {
+	if s.dst == nil {
+		return errors.New("nil AllocatingByteSliceSink *[]byte dst")
+	}
+	*s.dst = b
+	return nil
+}
+
+// TruncatingByteSliceSink returns a Sink that writes up to len(*dst)
+// bytes to *dst. If more bytes are available, they're silently
+// truncated. If fewer bytes are available than len(*dst), *dst
+// is shrunk to fit the number of bytes available.
+func TruncatingByteSliceSink(dst *[]byte) Sink {
+	return &truncBytesSink{dst: dst}
+}
+
+type truncBytesSink struct {
+	dst *[]byte
+}
+
+// setView copies straight from the cached bytes into *dst
+func (s *truncBytesSink) setView(v ByteView) error {
+	return s.SetBytes(v.data())
+}
+
+func (s *truncBytesSink) SetProto(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.SetBytes(b)
+}
+
+func (s *truncBytesSink) SetBytes(b []byte) error {
+	if s.dst == nil {
+		return errors.New("nil TruncatingByteSliceSink *[]byte dst")
+	}
+	n := copy(*s.dst, b)
+	*s.dst = (*s.dst)[:n]
+	return nil
+}
+
+func (s *truncBytesSink) SetString(v string) error {
+	if s.dst == nil {
+		return errors.New("nil TruncatingByteSliceSink *[]byte dst")
+	}
+	n := copy(*s.dst, v)
+	*s.dst = (*s.dst)[:n]
+	return nil
+}
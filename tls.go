@@ -0,0 +1,279 @@
+package dcache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+节点间通信使用mTLS: 双方都出示证书, 并用同一个CA校验对方.
+证书文件更新后(例如被cert-manager轮换)在下一次握手时自动重新加载, 无需重启.
+配置TrustDomain后还会校验对方证书中的SPIFFE ID, 只有成员列表中的节点可以通过.
+*/
+
+const defaultTLSReloadInterval = 30 * time.Second
+
+// TLSOptions configures mutual TLS between peers.
+type TLSOptions struct {
+	// CertFile and KeyFile hold this node's certificate, which is presented
+	// both as a server and as a client.
+	CertFile string
+	KeyFile  string
+	// CAFile holds the CA bundle that peer certificates must chain to.
+	CAFile string
+
+	// TrustDomain enables SPIFFE-style identity checks: a peer must present
+	// a URI SAN spiffe://<TrustDomain>/<host> where host is the host of an
+	// address in the pool's membership list.
+	TrustDomain string
+
+	// ReloadInterval is how often the files are checked for changes.
+	// If blank, it defaults to 30s.
+	ReloadInterval time.Duration
+}
+
+// PeerTLS holds reloadable credentials for mutual TLS between peers.
+// Set it in HTTPPoolOptions or GrpcPoolOptions.
+type PeerTLS struct {
+	opts TLSOptions
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	roots     *x509.CertPool
+	modTime   time.Time
+	lastCheck time.Time
+	members   []string // hosts of the membership list
+}
+
+// NewPeerTLS loads the certificates named in o.
+func NewPeerTLS(o TLSOptions) (*PeerTLS, error) {
+	if o.CertFile == "" || o.KeyFile == "" || o.CAFile == "" {
+		return nil, errors.New("dcache: CertFile, KeyFile and CAFile are required")
+	}
+	if o.ReloadInterval == 0 {
+		o.ReloadInterval = defaultTLSReloadInterval
+	}
+	t := &PeerTLS{opts: o}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *PeerTLS) load() error {
+	modTime, err := t.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(t.opts.CertFile, t.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("dcache: loading key pair: %w", err)
+	}
+	ca, err := os.ReadFile(t.opts.CAFile)
+	if err != nil {
+		return fmt.Errorf("dcache: reading CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("dcache: no certificates in %v", t.opts.CAFile)
+	}
+
+	t.mu.Lock()
+	t.cert, t.roots, t.modTime = &cert, roots, modTime
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *PeerTLS) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{t.opts.CertFile, t.opts.KeyFile, t.opts.CAFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// current returns the credentials, reloading them first if the files
+// changed. A failed reload keeps the old credentials.
+func (t *PeerTLS) current() (*tls.Certificate, *x509.CertPool) {
+	t.mu.Lock()
+	check := time.Since(t.lastCheck) >= t.opts.ReloadInterval
+	if check {
+		t.lastCheck = time.Now()
+	}
+	loaded := t.modTime
+	t.mu.Unlock()
+
+	if check {
+		if modTime, err := t.latestModTime(); err == nil && !modTime.Equal(loaded) {
+			if err := t.load(); err != nil {
+				log.Println("[DCache] Failed to reload TLS certificates", err)
+			}
+		}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert, t.roots
+}
+
+// setMembers updates the hosts allowed by the identity check
+func (t *PeerTLS) setMembers(addrs []string) {
+	hosts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		hosts = append(hosts, hostOf(addr))
+	}
+	t.mu.Lock()
+	t.members = hosts
+	t.mu.Unlock()
+}
+
+// hostOf returns the host of "http://host:port", "host:port" or "host"
+func hostOf(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// ServerConfig returns the tls.Config for serving peers, it requires and
+// verifies client certificates.
+func (t *PeerTLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		// 证书链在VerifyConnection中用最新加载的CA校验
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return t.verify(cs, x509.ExtKeyUsageClientAuth, "")
+		},
+	}
+}
+
+// ClientConfig returns the tls.Config for connecting to peers. The server
+// certificate is checked against the SNI sent in the handshake, which is
+// empty for peers addressed by IP, so such connections are refused. Use
+// DialTLSContext to check against the dialed host instead.
+func (t *PeerTLS) ClientConfig() *tls.Config {
+	return t.clientConfig("")
+}
+
+// DialTLSContext connects to a peer at addr and checks its certificate
+// against the host of addr, matching IP SANs for IP addresses. It can be
+// used as http.Transport.DialTLSContext.
+func (t *PeerTLS) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host := hostOf(addr)
+	cfg := t.clientConfig(host)
+	cfg.ServerName = host
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// clientConfig checks the server certificate against host,
+// or the SNI if host is blank
+func (t *PeerTLS) clientConfig(host string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := t.current()
+			return cert, nil
+		},
+		// 默认的校验无法使用重新加载的CA, 改为在VerifyConnection中校验
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if host == "" {
+				return t.verify(cs, x509.ExtKeyUsageServerAuth, cs.ServerName)
+			}
+			return t.verify(cs, x509.ExtKeyUsageServerAuth, host)
+		},
+	}
+}
+
+// verify checks the peer's certificate chain, and for a server without
+// TrustDomain that its certificate is valid for host
+func (t *PeerTLS) verify(cs tls.ConnectionState, usage x509.ExtKeyUsage, host string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("dcache: peer presented no certificate")
+	}
+	_, roots := t.current()
+	leaf := cs.PeerCertificates[0]
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	// 没有SPIFFE校验时, 客户端按拨号的主机名或IP校验服务端证书, 没有主机名时拒绝连接
+	if t.opts.TrustDomain == "" && usage == x509.ExtKeyUsageServerAuth {
+		if host == "" {
+			return errors.New("dcache: no host to verify the peer certificate against")
+		}
+		opts.DNSName = host
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return err
+	}
+	if t.opts.TrustDomain != "" {
+		return t.verifyIdentity(leaf)
+	}
+	return nil
+}
+
+// isMember reports whether the client of a connection presented the
+// identity of a member of the TrustDomain
+func (t *PeerTLS) isMember(cs *tls.ConnectionState) bool {
+	if t.opts.TrustDomain == "" || cs == nil || len(cs.PeerCertificates) == 0 {
+		return false
+	}
+	return t.verifyIdentity(cs.PeerCertificates[0]) == nil
+}
+
+// verifyIdentity checks the SPIFFE ID of cert against the membership list
+func (t *PeerTLS) verifyIdentity(cert *x509.Certificate) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var ids []string
+	for _, u := range cert.URIs {
+		if u.Scheme != "spiffe" {
+			continue
+		}
+		ids = append(ids, u.String())
+		if u.Host == t.opts.TrustDomain && slices.Contains(t.members, strings.TrimPrefix(u.Path, "/")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("dcache: peer identity %v is not a member of spiffe://%v", ids, t.opts.TrustDomain)
+}
@@ -0,0 +1,184 @@
+package dcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"dcache/lru"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A Codec converts values of type T to and from the bytes a Group caches
+// and peers exchange.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// JSONCodec encodes values with encoding/json.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob, every value carries its own
+// type description.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// ProtoCodec encodes protobuf messages, T is a generated message pointer
+// type such as *pb.Request.
+type ProtoCodec[T proto.Message] struct{}
+
+func (ProtoCodec[T]) Marshal(v T) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+func (ProtoCodec[T]) Unmarshal(data []byte) (T, error) {
+	var zero T
+	// generated messages answer ProtoReflect on a nil pointer too
+	v := zero.ProtoReflect().Type().New().Interface().(T)
+	if err := proto.Unmarshal(data, v); err != nil {
+		return zero, err
+	}
+	return v, nil
+}
+
+// A TypedGroup wraps a Group to get and set values of type T
+// instead of bytes, peers still exchange the encoded bytes.
+type TypedGroup[T any] struct {
+	group *Group
+	codec Codec[T]
+
+	mu      sync.Mutex                          // guards decoded
+	decoded *lru.Cache[string, decodedValue[T]] // nil if disabled
+}
+
+// decodedValue is a decoded object with the hash of the bytes it came from
+type decodedValue[T any] struct {
+	version uint64
+	value   T
+}
+
+// NewTypedGroup creates a group in DefaultRegistry whose getter returns
+// values of type T, encoded with codec.
+func NewTypedGroup[T any](name string, getter func(key string) (T, error), codec Codec[T], opts ...GroupOption) (*TypedGroup[T], error) {
+	g, err := NewGroup(name, GetterFunc(func(key string) ([]byte, error) {
+		v, err := getter(key)
+		if err != nil {
+			return nil, err
+		}
+		return codec.Marshal(v)
+	}), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return Typed(g, codec), nil
+}
+
+// Typed wraps an existing group whose values are encoded with codec.
+func Typed[T any](g *Group, codec Codec[T]) *TypedGroup[T] {
+	return &TypedGroup[T]{group: g, codec: codec}
+}
+
+// SetDecodedCache keeps up to n decoded objects, so that hot keys are not
+// decoded on every Get. Objects are shared between callers and must not be
+// modified. n = 0 disables it.
+func (t *TypedGroup[T]) SetDecodedCache(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n <= 0 {
+		t.decoded = nil
+		return
+	}
+	t.decoded = lru.New[string, decodedValue[T]](0, nil)
+	t.decoded.MaxEntries = n
+}
+
+// Group returns the underlying Group.
+func (t *TypedGroup[T]) Group() *Group {
+	return t.group
+}
+
+// Get returns the decoded value for key, see Group.Get.
+func (t *TypedGroup[T]) Get(ctx context.Context, key string, expire time.Time) (T, error) {
+	view, err := t.group.Get(ctx, key, expire)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	t.mu.Lock()
+	decoded := t.decoded
+	t.mu.Unlock()
+	if decoded == nil {
+		return t.codec.Unmarshal(view.data())
+	}
+
+	// 以字节的hash作为版本, 值被Set或重新加载后旧的对象自然失效.
+	// 压缩的值直接对压缩后的字节求hash, 命中时不需要解压
+	h := fnv.New64a()
+	h.Write(view.b)
+	version := h.Sum64()
+	t.mu.Lock()
+	if dv, ok := decoded.Get(key); ok && dv.version == version {
+		t.mu.Unlock()
+		return dv.value, nil
+	}
+	t.mu.Unlock()
+
+	v, err := t.codec.Unmarshal(view.data())
+	if err != nil {
+		return v, err
+	}
+	t.mu.Lock()
+	decoded.Add(key, decodedValue[T]{version: version, value: v}, time.Time{})
+	t.mu.Unlock()
+	return v, nil
+}
+
+// Set encodes v and stores it for key in this node's cache, see Group.Set.
+func (t *TypedGroup[T]) Set(key string, v T, expire time.Time) error {
+	data, err := t.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.group.Set(key, data, expire)
+	return nil
+}
+
+// Remove invalidates key in this node's cache.
+func (t *TypedGroup[T]) Remove(key string) {
+	t.group.Remove(key)
+	t.mu.Lock()
+	if t.decoded != nil {
+		t.decoded.Remove(key)
+	}
+	t.mu.Unlock()
+}